@@ -0,0 +1,169 @@
+package minivmm
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+
+	"github.com/mackerelio/go-osstat/cpu"
+	"github.com/mackerelio/go-osstat/memory"
+	"github.com/pkg/errors"
+)
+
+// CapacityExceededError is returned when a VM does not fit in the host capacity multiplied by the overcommit ratio.
+type CapacityExceededError struct {
+	Resource  string `json:"resource"`
+	Capacity  int64  `json:"capacity"`
+	Allocated int64  `json:"allocated"`
+	Requested int64  `json:"requested"`
+	Shortfall int64  `json:"shortfall"`
+}
+
+func (e *CapacityExceededError) Error() string {
+	return fmt.Sprintf("insufficient host %s: capacity %d, allocated %d, requested %d, shortfall %d",
+		e.Resource, e.Capacity, e.Allocated, e.Requested, e.Shortfall)
+}
+
+// getAllocatedResources returns the vCPUs and memory in bytes of the running VMs, and the disk in bytes of all VMs.
+func getAllocatedResources() (int64, int64, int64, error) {
+	vms, err := ListVMs()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	var cpus, mem, disk int64
+	for _, vm := range vms {
+		d, err := getVMDiskBytes(vm)
+		if err != nil {
+			log.Printf("failed to parse disk info, %v\n", err)
+		}
+		disk += d
+		for _, vol := range vm.ExtraVolumes {
+			size, err := parseBytes(vol.Size)
+			if err != nil {
+				log.Printf("failed to parse volume size, %v\n", err)
+			}
+			disk += size
+		}
+
+		// the cached status may not follow the VMs just started yet, but their QEMU processes are alive
+		if vm.Status != "running" && vm.Status != "paused" && !isQemuProcessAlive(vm.Name) {
+			continue
+		}
+		c, err := strconv.ParseInt(vm.CPU, 10, 64)
+		if err != nil {
+			log.Printf("failed to parse cpu info, %v\n", err)
+		}
+		cpus += c
+		m, err := parseMemoryBytes(vm.Memory)
+		if err != nil {
+			log.Printf("failed to parse memory info, %v\n", err)
+		}
+		mem += m
+	}
+	return cpus, mem, disk, nil
+}
+
+// admissionReservations is the resources admitted but not allocated yet, such as the VMs being started.
+// They are counted as allocated, so that concurrent requests cannot exceed the capacity together.
+var admissionReservations = struct {
+	sync.Mutex
+	pending QuotaRequest
+}{}
+
+// reserveAdmission checks the host can accept the VM of the size and reserves it. The returned function releases
+// the reservation and must be called after the resources are allocated. It can be called more than once.
+func reserveAdmission(req QuotaRequest) (func(), error) {
+	admissionReservations.Lock()
+	defer admissionReservations.Unlock()
+	err := checkAdmission(req)
+	if err != nil {
+		return nil, err
+	}
+	inc := req.increase()
+	admissionReservations.pending = admissionReservations.pending.add(inc, 1)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			admissionReservations.Lock()
+			defer admissionReservations.Unlock()
+			admissionReservations.pending = admissionReservations.pending.add(inc, -1)
+		})
+	}, nil
+}
+
+// checkAdmission checks the host can accept the VM of the size. A ratio of 0 disables the check of the resource.
+// admissionReservations must be locked.
+func checkAdmission(req QuotaRequest) error {
+	if C.CPUOvercommitRatio <= 0 && C.MemoryOvercommitRatio <= 0 && C.DiskOvercommitRatio <= 0 {
+		return nil
+	}
+
+	allocCPU, allocMem, allocDisk, err := getAllocatedResources()
+	if err != nil {
+		return err
+	}
+	pending := admissionReservations.pending
+	allocCPU += int64(pending.CPU)
+	allocMem += pending.Memory
+	allocDisk += pending.Disk
+	cpuStat, err := cpu.Get()
+	if err != nil {
+		return err
+	}
+	memStat, err := memory.Get()
+	if err != nil {
+		return err
+	}
+
+	for _, c := range []struct {
+		resource  string
+		ratio     float64
+		capacity  uint64
+		allocated int64
+		requested int64
+	}{
+		{"cpu", C.CPUOvercommitRatio, uint64(cpuStat.CPUCount), allocCPU, int64(req.CPU)},
+		{"memory", C.MemoryOvercommitRatio, memStat.Total, allocMem, req.Memory},
+		{"disk", C.DiskOvercommitRatio, getDiskSizeTotal(C.Dir), allocDisk, req.Disk},
+	} {
+		err := checkCapacity(c.resource, c.ratio, c.capacity, c.allocated, c.requested)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkCapacity checks the requested resource fits in the host capacity multiplied by the overcommit ratio.
+func checkCapacity(resource string, ratio float64, hostCapacity uint64, allocated, requested int64) error {
+	if ratio <= 0 || requested <= 0 {
+		return nil
+	}
+	capacity := int64(float64(hostCapacity) * ratio)
+	if shortfall := allocated + requested - capacity; shortfall > 0 {
+		return &CapacityExceededError{
+			Resource:  resource,
+			Capacity:  capacity,
+			Allocated: allocated,
+			Requested: requested,
+			Shortfall: shortfall,
+		}
+	}
+	return nil
+}
+
+// reserveStartAdmission checks the host can run the stopped VM and reserves its vCPUs and memory.
+func reserveStartAdmission(metaData *VMMetaData) (func(), error) {
+	req, err := newQuotaRequest(metaData.CPU, metaData.Memory, "")
+	if err != nil {
+		return nil, err
+	}
+	release, err := reserveAdmission(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "Cannot start VM")
+	}
+	return release, nil
+}
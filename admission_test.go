@@ -0,0 +1,38 @@
+package minivmm
+
+import "testing"
+
+func TestCheckCapacity(t *testing.T) {
+	for _, c := range []struct {
+		name      string
+		ratio     float64
+		capacity  uint64
+		allocated int64
+		requested int64
+		shortfall int64
+	}{
+		{"disabled", 0, 4, 100, 1, 0},
+		{"fit", 1, 4, 2, 2, 0},
+		{"exceeded", 1, 4, 3, 2, 1},
+		{"overcommit fit", 2.5, 4, 8, 2, 0},
+		{"overcommit exceeded", 2.5, 4, 8, 5, 3},
+		{"already over", 1, 4, 6, 1, 3},
+		{"shrink", 1, 4, 6, -1, 0},
+	} {
+		err := checkCapacity("cpu", c.ratio, c.capacity, c.allocated, c.requested)
+		if c.shortfall == 0 {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", c.name, err)
+			}
+			continue
+		}
+		e, ok := err.(*CapacityExceededError)
+		if !ok {
+			t.Errorf("%s: expected CapacityExceededError but got %v", c.name, err)
+			continue
+		}
+		if e.Shortfall != c.shortfall {
+			t.Errorf("%s: unexpected shortfall; expected:%d actual:%d", c.name, c.shortfall, e.Shortfall)
+		}
+	}
+}
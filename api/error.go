@@ -3,6 +3,10 @@ package api
 import (
 	"encoding/json"
 	"net/http"
+
+	"github.com/pkg/errors"
+
+	"minivmm"
 )
 
 func writeForbidden(w http.ResponseWriter) {
@@ -13,8 +17,27 @@ func writeForbidden(w http.ResponseWriter) {
 }
 
 func writeInternalServerError(err error, w http.ResponseWriter) {
-	w.WriteHeader(http.StatusInternalServerError)
+	if errors.Cause(err) == minivmm.ErrNetworkNotOwned {
+		writeForbidden(w)
+		return
+	}
+	switch cause := errors.Cause(err).(type) {
+	case *minivmm.QuotaExceededError:
+		w.WriteHeader(http.StatusForbidden)
+	case *minivmm.CapacityExceededError:
+		writeConflict(err, cause, w)
+		return
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+	}
 	ret := map[string]string{"error": err.Error()}
 	b, _ := json.Marshal(ret)
 	w.Write(b)
 }
+
+func writeConflict(err error, detail *minivmm.CapacityExceededError, w http.ResponseWriter) {
+	w.WriteHeader(http.StatusConflict)
+	ret := map[string]interface{}{"error": err.Error(), "detail": detail}
+	b, _ := json.Marshal(ret)
+	w.Write(b)
+}
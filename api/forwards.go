@@ -70,6 +70,13 @@ func CreateForward(w http.ResponseWriter, r *http.Request) {
 	f := parseForwardBody(r.Body)
 	f.Owner = minivmm.GetUserName(r)
 
+	release, err := minivmm.ReserveQuota(f.Owner, minivmm.QuotaRequest{Forwards: 1})
+	if err != nil {
+		writeInternalServerError(err, w)
+		return
+	}
+	defer release()
+
 	if f.FromPort == "" {
 		rangeMin, rangeMax := portRangePerUser(minivmm.GetUserName(r))
 		port, err := minivmm.GetRandomForwardPort(f.Proto, rangeMin, rangeMax)
@@ -82,7 +89,7 @@ func CreateForward(w http.ResponseWriter, r *http.Request) {
 
 	log.Println(f)
 
-	err := minivmm.StartForward(f.Proto, f.FromPort, f.ToName, f.ToPort)
+	err = minivmm.StartForward(f)
 	if err != nil {
 		writeInternalServerError(err, w)
 		return
@@ -1,33 +1,167 @@
 package api
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
+	"regexp"
+	"strings"
 
 	"minivmm"
 )
 
-type image struct {
-	Name string `json:"name"`
+var (
+	vmImageAPI     = regexp.MustCompile(`^/api/v1/vms/[^/]+/images$`)
+	imageImportAPI = regexp.MustCompile(`^/api/v1/images/imports$`)
+)
+
+type imageImportRequest struct {
+	minivmm.ImageMetaData
+	URL      string `json:"url"`
+	Checksum string `json:"checksum"`
+}
+
+type vmImageRequest struct {
+	minivmm.ImageMetaData
+	Sparsify string `json:"sparsify"`
+	Compress string `json:"compress"`
 }
 
 // HandleImages handles image resource request.
 func HandleImages(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet && imageImportAPI.MatchString(r.URL.String()) {
+		ListImageImports(w, r)
+		return
+	}
+
 	if r.Method == http.MethodGet {
 		ListImages(w, r)
 		return
 	}
+	if r.Method == http.MethodPost {
+		ImportImage(w, r)
+		return
+	}
+	if r.Method == http.MethodDelete {
+		DeleteImage(w, r)
+		return
+	}
 	w.WriteHeader(http.StatusMethodNotAllowed)
 }
 
 // ListImages returns a list of images.
 func ListImages(w http.ResponseWriter, r *http.Request) {
-	imgs := []*image{}
-	names := minivmm.ListBaseImages()
-	for _, n := range names {
-		imgs = append(imgs, &image{n})
+	ret := map[string][]*minivmm.ImageMetaData{"images": minivmm.ListImageMetaData()}
+	b, _ := json.Marshal(ret)
+	w.Write(b)
+}
+
+// DeleteImage deletes the image if it's not used by any VM.
+func DeleteImage(w http.ResponseWriter, r *http.Request) {
+	paths := strings.Split(r.URL.String(), "/")
+	name := paths[len(paths)-1]
+
+	metaData, err := minivmm.GetImageMetaData(name)
+	if err != nil {
+		writeInternalServerError(err, w)
+		return
+	}
+	// the images without owner are put by the administrator, so they cannot be deleted via API
+	if metaData.Owner == "" || metaData.Owner != minivmm.GetUserName(r) {
+		writeForbidden(w)
+		return
+	}
+
+	err = minivmm.DeleteImage(name)
+	if err != nil {
+		writeInternalServerError(err, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// CreateImageFromVM creates a new base image from the VM's disk.
+func CreateImageFromVM(w http.ResponseWriter, r *http.Request) {
+	paths := strings.Split(r.URL.String(), "/")
+	vmName := paths[len(paths)-2]
+
+	err := restrictVMOperationByOwner(w, r, vmName)
+	if err != nil {
+		return
+	}
+
+	defer r.Body.Close()
+
+	buf := new(bytes.Buffer)
+	io.Copy(buf, r.Body)
+
+	var req vmImageRequest
+	json.Unmarshal(buf.Bytes(), &req)
+	fmt.Printf("%v\n", req)
+
+	req.Owner = minivmm.GetUserName(r)
+	name, err := minivmm.CreateBaseImageFromVM(vmName, req.Name, &req.ImageMetaData, req.Sparsify == "true", req.Compress == "true")
+	if err != nil {
+		writeInternalServerError(err, w)
+		return
+	}
+
+	metaData, err := minivmm.GetImageMetaData(name)
+	if err != nil {
+		writeInternalServerError(err, w)
+		return
+	}
+
+	b, _ := json.Marshal(metaData)
+	w.Write(b)
+}
+
+// ImportImage imports a new base image from the URL or the uploaded request body.
+// For uploading, the image name, its checksum and metadata are given as query parameters.
+func ImportImage(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		buf := new(bytes.Buffer)
+		io.Copy(buf, r.Body)
+
+		var req imageImportRequest
+		json.Unmarshal(buf.Bytes(), &req)
+		fmt.Printf("%v\n", req)
+
+		req.Owner = minivmm.GetUserName(r)
+		err := minivmm.ImportImageFromURL(req.Name, req.URL, req.Checksum, &req.ImageMetaData)
+		if err != nil {
+			writeInternalServerError(err, w)
+			return
+		}
+	} else {
+		q := r.URL.Query()
+		metaData := &minivmm.ImageMetaData{
+			OSFamily:    q.Get("os_family"),
+			Arch:        q.Get("arch"),
+			DefaultUser: q.Get("default_user"),
+			MinDisk:     q.Get("min_disk"),
+			MinMemory:   q.Get("min_memory"),
+			Description: q.Get("description"),
+			Owner:       minivmm.GetUserName(r),
+		}
+		err := minivmm.ImportImageFromReader(q.Get("name"), q.Get("checksum"), r.Body, r.ContentLength, metaData)
+		if err != nil {
+			writeInternalServerError(err, w)
+			return
+		}
 	}
-	ret := map[string][]*image{"images": imgs}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// ListImageImports returns the progress of image importings.
+func ListImageImports(w http.ResponseWriter, r *http.Request) {
+	ret := map[string][]minivmm.ImageImport{"imports": minivmm.ListImageImports()}
 	b, _ := json.Marshal(ret)
 	w.Write(b)
 }
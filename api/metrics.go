@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+	"os"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -17,9 +18,27 @@ type minivmmExporter struct {
 	memBytes  *prometheus.GaugeVec
 	diskBytes prometheus.Gauge
 	numVM     *prometheus.GaugeVec
+
+	hostname string
+
+	vmCPUSeconds      *prometheus.Desc
+	vmRSSBytes        *prometheus.Desc
+	vmDiskBytes       *prometheus.Desc
+	vmDiskOps         *prometheus.Desc
+	vmNetBytes        *prometheus.Desc
+	vmGuestMemBytes   *prometheus.Desc
+	vmBalloonMemBytes *prometheus.Desc
+}
+
+// vmLabels are the labels of the per-VM series.
+var vmLabels = []string{"name", "owner", "tag", "hypervisor"}
+
+func newVMDesc(name, help string, labels ...string) *prometheus.Desc {
+	return prometheus.NewDesc(prometheus.BuildFQName(promNamespace, "vm", name), help, append(append([]string{}, vmLabels...), labels...), nil)
 }
 
 func NewMinivmmExporter() *minivmmExporter {
+	hostname, _ := os.Hostname()
 	return &minivmmExporter{
 		cpuCores: prometheus.NewGaugeVec(
 			prometheus.GaugeOpts{
@@ -52,6 +71,14 @@ func NewMinivmmExporter() *minivmmExporter {
 			},
 			[]string{"state"},
 		),
+		hostname:          hostname,
+		vmCPUSeconds:      newVMDesc("cpu_seconds_total", "the CPU time consumed by the QEMU process"),
+		vmRSSBytes:        newVMDesc("rss_bytes", "the resident memory of the QEMU process"),
+		vmDiskBytes:       newVMDesc("disk_bytes_total", "the bytes read from or written to the disk", "disk", "op"),
+		vmDiskOps:         newVMDesc("disk_operations_total", "the read or write operations on the disk", "disk", "op"),
+		vmNetBytes:        newVMDesc("network_bytes_total", "the bytes the guest received or transmitted", "direction"),
+		vmGuestMemBytes:   newVMDesc("guest_memory_bytes", "the guest memory statistics reported by the balloon driver", "type"),
+		vmBalloonMemBytes: newVMDesc("balloon_actual_bytes", "the memory size of the guest after ballooning"),
 	}
 }
 
@@ -60,6 +87,13 @@ func (e minivmmExporter) Describe(ch chan<- *prometheus.Desc) {
 	e.memBytes.Describe(ch)
 	ch <- e.diskBytes.Desc()
 	e.numVM.Describe(ch)
+	ch <- e.vmCPUSeconds
+	ch <- e.vmRSSBytes
+	ch <- e.vmDiskBytes
+	ch <- e.vmDiskOps
+	ch <- e.vmNetBytes
+	ch <- e.vmGuestMemBytes
+	ch <- e.vmBalloonMemBytes
 }
 
 func (e *minivmmExporter) Collect(ch chan<- prometheus.Metric) {
@@ -80,6 +114,49 @@ func (e *minivmmExporter) Collect(ch chan<- prometheus.Metric) {
 	e.memBytes.Collect(ch)
 	ch <- prometheus.MustNewConstMetric(e.diskBytes.Desc(), prometheus.GaugeValue, float64(m.DiskBytes))
 	e.numVM.Collect(ch)
+
+	e.collectVMs(ch)
+}
+
+func (e *minivmmExporter) collectVMs(ch chan<- prometheus.Metric) {
+	metrics, err := minivmm.ListVMLiveMetrics()
+	if err != nil {
+		log.Printf("failed to get VM metrics; %v", err)
+		return
+	}
+
+	for _, m := range metrics {
+		labels := []string{m.Name, m.Owner, m.Tag, e.hostname}
+		with := func(extra ...string) []string {
+			return append(append([]string{}, labels...), extra...)
+		}
+
+		ch <- prometheus.MustNewConstMetric(e.vmCPUSeconds, prometheus.CounterValue, m.CPUSeconds, labels...)
+		ch <- prometheus.MustNewConstMetric(e.vmRSSBytes, prometheus.GaugeValue, float64(m.RSSBytes), labels...)
+		for _, d := range m.Disks {
+			ch <- prometheus.MustNewConstMetric(e.vmDiskBytes, prometheus.CounterValue, float64(d.ReadBytes), with(d.Disk, "read")...)
+			ch <- prometheus.MustNewConstMetric(e.vmDiskBytes, prometheus.CounterValue, float64(d.WriteBytes), with(d.Disk, "write")...)
+			ch <- prometheus.MustNewConstMetric(e.vmDiskOps, prometheus.CounterValue, float64(d.ReadOps), with(d.Disk, "read")...)
+			ch <- prometheus.MustNewConstMetric(e.vmDiskOps, prometheus.CounterValue, float64(d.WriteOps), with(d.Disk, "write")...)
+		}
+		ch <- prometheus.MustNewConstMetric(e.vmNetBytes, prometheus.CounterValue, float64(m.NetRxBytes), with("rx")...)
+		ch <- prometheus.MustNewConstMetric(e.vmNetBytes, prometheus.CounterValue, float64(m.NetTxBytes), with("tx")...)
+
+		if m.Memory == nil {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(e.vmBalloonMemBytes, prometheus.GaugeValue, float64(m.Memory.ActualBytes), labels...)
+		for typ, v := range map[string]int64{
+			"total":     m.Memory.TotalBytes,
+			"free":      m.Memory.FreeBytes,
+			"available": m.Memory.AvailableBytes,
+			"cached":    m.Memory.CachedBytes,
+		} {
+			if v >= 0 {
+				ch <- prometheus.MustNewConstMetric(e.vmGuestMemBytes, prometheus.GaugeValue, float64(v), with(typ)...)
+			}
+		}
+	}
 }
 
 // HandleJsonMetrics handles json metrics request.
@@ -0,0 +1,97 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"minivmm"
+)
+
+// HandleNetworks handles network resource request.
+func HandleNetworks(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		ListNetworks(w, r)
+		return
+	}
+	if r.Method == http.MethodPost {
+		CreateNetwork(w, r)
+		return
+	}
+	if r.Method == http.MethodDelete {
+		RemoveNetwork(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusMethodNotAllowed)
+}
+
+// ListNetworks returns a list of networks. The networks are shared by all users.
+func ListNetworks(w http.ResponseWriter, r *http.Request) {
+	networks, err := minivmm.ListNetworks()
+	if err != nil {
+		writeInternalServerError(err, w)
+		return
+	}
+
+	ret := map[string][]*minivmm.Network{"networks": networks}
+	b, _ := json.Marshal(ret)
+	w.Write(b)
+}
+
+// CreateNetwork creates a network.
+func CreateNetwork(w http.ResponseWriter, r *http.Request) {
+	body := r.Body
+	defer body.Close()
+
+	buf := new(bytes.Buffer)
+	io.Copy(buf, body)
+
+	var n minivmm.Network
+	json.Unmarshal(buf.Bytes(), &n)
+	n.Owner = minivmm.GetUserName(r)
+
+	network, err := minivmm.CreateNetwork(&n)
+	if err != nil {
+		writeInternalServerError(err, w)
+		return
+	}
+
+	b, _ := json.Marshal(network)
+	w.Write(b)
+}
+
+// RemoveNetwork removes a network.
+func RemoveNetwork(w http.ResponseWriter, r *http.Request) {
+	paths := strings.Split(r.URL.String(), "/")
+	name := paths[len(paths)-1]
+
+	err := restrictNetworkOperationByOwner(w, r, name)
+	if err != nil {
+		return
+	}
+
+	err = minivmm.RemoveNetwork(name)
+	if err != nil {
+		writeInternalServerError(err, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func restrictNetworkOperationByOwner(w http.ResponseWriter, r *http.Request, name string) error {
+	n, err := minivmm.GetNetwork(name)
+	if err != nil {
+		writeInternalServerError(err, w)
+		return err
+	}
+
+	if n.Owner != minivmm.GetUserName(r) {
+		writeForbidden(w)
+		return fmt.Errorf("forbidden")
+	}
+	return nil
+}
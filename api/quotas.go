@@ -0,0 +1,37 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"minivmm"
+)
+
+// HandleQuotas handles quota resource request.
+func HandleQuotas(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		GetQuota(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusMethodNotAllowed)
+}
+
+// GetQuota returns the quota and the usage of the user.
+func GetQuota(w http.ResponseWriter, r *http.Request) {
+	user := minivmm.GetUserName(r)
+
+	quota, err := minivmm.GetQuota(user)
+	if err != nil {
+		writeInternalServerError(err, w)
+		return
+	}
+	usage, err := minivmm.GetQuotaUsage(user)
+	if err != nil {
+		writeInternalServerError(err, w)
+		return
+	}
+
+	ret := map[string]interface{}{"limit": quota, "usage": usage}
+	b, _ := json.Marshal(ret)
+	w.Write(b)
+}
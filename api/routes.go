@@ -13,7 +13,11 @@ func RegisterHandlers(mux *http.ServeMux) {
 	registerWithAuth(mux, prefix+"/vms", HandleVMs)
 	registerWithAuth(mux, prefix+"/vms/", HandleVMs)
 	registerWithAuth(mux, prefix+"/forwards", HandleForwards)
+	registerWithAuth(mux, prefix+"/networks", HandleNetworks)
+	registerWithAuth(mux, prefix+"/networks/", HandleNetworks)
+	registerWithAuth(mux, prefix+"/quotas", HandleQuotas)
 	registerWithAuth(mux, prefix+"/images", HandleImages)
+	registerWithAuth(mux, prefix+"/images/", HandleImages)
 	registerWithAuth(mux, prefix+"/metrics/json", HandleJsonMetrics)
 
 	mux.HandleFunc(prefix+"/login", HandleOIDCCallback)
@@ -0,0 +1,146 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"minivmm"
+)
+
+var (
+	snapshotAPI       = regexp.MustCompile(`^/api/v1/vms/[^/]+/snapshots(/[^/]+)?$`)
+	revertSnapshotAPI = regexp.MustCompile(`^/api/v1/vms/[^/]+/snapshots/[^/]+/revert$`)
+)
+
+type snapshot struct {
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// HandleSnapshots handles VM snapshot resource request.
+func HandleSnapshots(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost && revertSnapshotAPI.MatchString(r.URL.String()) {
+		RevertSnapshot(w, r)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		ListSnapshots(w, r)
+		return
+	}
+	if r.Method == http.MethodPost {
+		CreateSnapshot(w, r)
+		return
+	}
+	if r.Method == http.MethodDelete {
+		DeleteSnapshot(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusMethodNotAllowed)
+}
+
+// ListSnapshots returns a list of snapshots of the VM.
+func ListSnapshots(w http.ResponseWriter, r *http.Request) {
+	paths := strings.Split(r.URL.String(), "/")
+	vmName := paths[4]
+
+	err := restrictVMOperationByOwner(w, r, vmName)
+	if err != nil {
+		return
+	}
+
+	snaps, err := minivmm.ListSnapshots(vmName)
+	if err != nil {
+		writeInternalServerError(err, w)
+		return
+	}
+
+	ss := []*snapshot{}
+	for _, s := range snaps {
+		ss = append(ss, &snapshot{s.Name, s.CreatedAt})
+	}
+	ret := map[string][]*snapshot{"snapshots": ss}
+	b, _ := json.Marshal(ret)
+	w.Write(b)
+}
+
+// CreateSnapshot takes a new snapshot of the VM.
+func CreateSnapshot(w http.ResponseWriter, r *http.Request) {
+	paths := strings.Split(r.URL.String(), "/")
+	vmName := paths[4]
+
+	err := restrictVMOperationByOwner(w, r, vmName)
+	if err != nil {
+		return
+	}
+
+	defer r.Body.Close()
+
+	buf := new(bytes.Buffer)
+	io.Copy(buf, r.Body)
+
+	var s snapshot
+	json.Unmarshal(buf.Bytes(), &s)
+	fmt.Printf("%v\n", s)
+
+	metaData, err := minivmm.CreateSnapshot(vmName, s.Name)
+	if err != nil {
+		writeInternalServerError(err, w)
+		return
+	}
+
+	b, _ := json.Marshal(metaData)
+	w.Write(b)
+}
+
+// RevertSnapshot reverts the VM to the snapshot.
+func RevertSnapshot(w http.ResponseWriter, r *http.Request) {
+	paths := strings.Split(r.URL.String(), "/")
+	vmName := paths[4]
+	snapName := paths[6]
+
+	err := restrictVMOperationByOwner(w, r, vmName)
+	if err != nil {
+		return
+	}
+
+	metaData, err := minivmm.RevertSnapshot(vmName, snapName)
+	if err != nil {
+		writeInternalServerError(err, w)
+		return
+	}
+
+	b, _ := json.Marshal(metaData)
+	w.Write(b)
+}
+
+// DeleteSnapshot deletes the snapshot of the VM.
+func DeleteSnapshot(w http.ResponseWriter, r *http.Request) {
+	paths := strings.Split(r.URL.String(), "/")
+	if len(paths) < 7 {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	vmName := paths[4]
+	snapName := paths[6]
+
+	err := restrictVMOperationByOwner(w, r, vmName)
+	if err != nil {
+		return
+	}
+
+	metaData, err := minivmm.DeleteSnapshot(vmName, snapName)
+	if err != nil {
+		writeInternalServerError(err, w)
+		return
+	}
+
+	b, _ := json.Marshal(metaData)
+	w.Write(b)
+}
@@ -11,6 +11,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"minivmm"
 )
@@ -18,22 +19,47 @@ import (
 var (
 	updateVMAPI    = regexp.MustCompile(`^/api/v1/vms/[^/]+$`)
 	extraVolumeAPI = regexp.MustCompile(`^/api/v1/vms/[^/]+/volumes.*$`)
+	cloneVMAPI     = regexp.MustCompile(`^/api/v1/vms/[^/]+/clone$`)
 )
 
 type vm struct {
-	Name         string        `json:"name"`
-	Status       string        `json:"status"`
-	Owner        string        `json:"owner"`
-	Hypervisor   string        `json:"hypervisor"`
-	Image        string        `json:"image"`
-	IP           string        `json:"ip"`
-	CPU          string        `json:"cpu"`
-	Memory       string        `json:"memory"`
-	Disk         string        `json:"disk"`
-	Tag          string        `json:"tag"`
-	Lock         string        `json:"lock"`
-	UserData     string        `json:"user_data"`
-	ExtraVolumes []extraVolume `json:"extra_volumes"`
+	Name         string             `json:"name"`
+	Status       string             `json:"status"`
+	Owner        string             `json:"owner"`
+	Hypervisor   string             `json:"hypervisor"`
+	Image        string             `json:"image"`
+	Arch         string             `json:"arch"`
+	Firmware     string             `json:"firmware"`
+	TPM          string             `json:"tpm"`
+	Hardware     *minivmm.Hardware  `json:"hardware"`
+	TargetMemory string             `json:"target_memory"`
+	QoS          *minivmm.QoS       `json:"qos"`
+	IP           string             `json:"ip"`
+	StaticIP     string             `json:"static_ip"`
+	Network      string             `json:"network"`
+	ExtraNICs    []minivmm.ExtraNIC `json:"extra_nics"`
+	CPU          string             `json:"cpu"`
+	Memory       string             `json:"memory"`
+	Disk         string             `json:"disk"`
+	Tag          string             `json:"tag"`
+	Lock         string             `json:"lock"`
+	UserData     string             `json:"user_data"`
+	ExtraVolumes []extraVolume      `json:"extra_volumes"`
+
+	StatusChangedAt time.Time `json:"status_changed_at"`
+	StatusReason    string    `json:"status_reason"`
+
+	Autostart      string `json:"autostart"`
+	AutostartOrder string `json:"autostart_order"`
+
+	RestartPolicy string `json:"restart_policy"`
+	CrashCount    string `json:"crash_count"`
+}
+
+type cloneRequest struct {
+	Name         string `json:"name"`
+	UserData     string `json:"user_data"`
+	KeepUserData string `json:"keep_user_data"`
 }
 
 type extraVolume struct {
@@ -43,6 +69,19 @@ type extraVolume struct {
 
 // HandleVMs handles virtual machine resource request.
 func HandleVMs(w http.ResponseWriter, r *http.Request) {
+	if snapshotAPI.MatchString(r.URL.String()) || revertSnapshotAPI.MatchString(r.URL.String()) {
+		HandleSnapshots(w, r)
+		return
+	}
+
+	if r.Method == http.MethodPost && vmImageAPI.MatchString(r.URL.String()) {
+		CreateImageFromVM(w, r)
+		return
+	}
+	if r.Method == http.MethodPost && cloneVMAPI.MatchString(r.URL.String()) {
+		CloneVM(w, r)
+		return
+	}
 	if r.Method == http.MethodPost && extraVolumeAPI.MatchString(r.URL.String()) {
 		CreateVolume(w, r)
 		return
@@ -98,13 +137,31 @@ func ListVMs(w http.ResponseWriter, r *http.Request) {
 			Owner:        metaData.Owner,
 			Hypervisor:   hostname,
 			Image:        metaData.Image,
+			Arch:         metaData.Arch,
+			Firmware:     metaData.Firmware,
+			TPM:          strconv.FormatBool(metaData.TPM),
+			Hardware:     metaData.Hardware,
+			TargetMemory: metaData.TargetMemory,
+			QoS:          metaData.QoS,
 			IP:           metaData.IPAddress,
+			StaticIP:     metaData.StaticIPAddress,
+			Network:      metaData.Network,
+			ExtraNICs:    metaData.ExtraNICs,
 			CPU:          metaData.CPU,
 			Memory:       metaData.Memory,
 			Disk:         metaData.Disk,
 			Lock:         strconv.FormatBool(metaData.Lock),
 			Tag:          metaData.Tag,
 			ExtraVolumes: ev,
+
+			StatusChangedAt: metaData.StatusChangedAt,
+			StatusReason:    metaData.StatusReason,
+
+			Autostart:      metaData.Autostart,
+			AutostartOrder: strconv.Itoa(metaData.AutostartOrder),
+
+			RestartPolicy: metaData.RestartPolicy,
+			CrashCount:    strconv.Itoa(metaData.CrashCount),
 		}
 		vms = append(vms, &vm)
 	}
@@ -125,7 +182,40 @@ func CreateVM(w http.ResponseWriter, r *http.Request) {
 	json.Unmarshal(buf.Bytes(), &v)
 	fmt.Printf("%v\n", v)
 
-	metaData, err := minivmm.CreateVM(v.Name, minivmm.GetUserName(r), v.Image, v.CPU, v.Memory, v.Disk, v.UserData, v.Tag)
+	extraNetworks := []string{}
+	for _, nic := range v.ExtraNICs {
+		extraNetworks = append(extraNetworks, nic.Network)
+	}
+	metaData, err := minivmm.CreateVM(v.Name, minivmm.GetUserName(r), v.Image, v.Arch, v.Firmware, v.TPM == "true", v.Hardware, v.QoS, v.CPU, v.Memory, v.Disk, v.UserData, v.Tag, v.Network, v.StaticIP, extraNetworks)
+	if err != nil {
+		writeInternalServerError(err, w)
+		return
+	}
+
+	b, _ := json.Marshal(metaData)
+	w.Write(b)
+}
+
+// CloneVM creates a new VM from the existing VM.
+func CloneVM(w http.ResponseWriter, r *http.Request) {
+	paths := strings.Split(r.URL.String(), "/")
+	srcName := paths[len(paths)-2]
+
+	err := restrictVMOperationByOwner(w, r, srcName)
+	if err != nil {
+		return
+	}
+
+	defer r.Body.Close()
+
+	buf := new(bytes.Buffer)
+	io.Copy(buf, r.Body)
+
+	var c cloneRequest
+	json.Unmarshal(buf.Bytes(), &c)
+	fmt.Printf("%v\n", c)
+
+	metaData, err := minivmm.CloneVM(srcName, c.Name, minivmm.GetUserName(r), c.UserData, c.KeepUserData == "true")
 	if err != nil {
 		writeInternalServerError(err, w)
 		return
@@ -160,6 +250,8 @@ func UpdateVM(w http.ResponseWriter, r *http.Request) {
 			_, err = minivmm.StartVM(vmName)
 		} else if v.Status == "stop" {
 			err = minivmm.StopVM(vmName)
+		} else if v.Status == "suspend" {
+			err = minivmm.SuspendVM(vmName)
 		}
 		if err != nil {
 			writeInternalServerError(err, w)
@@ -178,6 +270,66 @@ func UpdateVM(w http.ResponseWriter, r *http.Request) {
 		w.Write(b)
 	}
 
+	if v.Hardware != nil {
+		// the other hardware fields are fixed at create
+		if *v.Hardware != (minivmm.Hardware{CPU: v.Hardware.CPU}) {
+			writeInternalServerError(fmt.Errorf("only hardware.cpu can be updated"), w)
+			return
+		}
+		metaData, err := minivmm.UpdateVMCPU(vmName, v.Hardware.CPU)
+		if err != nil {
+			writeInternalServerError(err, w)
+			return
+		}
+
+		b, _ := json.Marshal(metaData)
+		w.Write(b)
+	}
+
+	if v.QoS != nil {
+		metaData, err := minivmm.SetVMQoS(vmName, v.QoS)
+		if err != nil {
+			writeInternalServerError(err, w)
+			return
+		}
+
+		b, _ := json.Marshal(metaData)
+		w.Write(b)
+	}
+
+	if v.TargetMemory != "" {
+		metaData, err := minivmm.SetVMTargetMemory(vmName, v.TargetMemory)
+		if err != nil {
+			writeInternalServerError(err, w)
+			return
+		}
+
+		b, _ := json.Marshal(metaData)
+		w.Write(b)
+	}
+
+	if v.Autostart != "" || v.AutostartOrder != "" {
+		metaData, err := minivmm.SetVMAutostart(vmName, v.Autostart, v.AutostartOrder)
+		if err != nil {
+			writeInternalServerError(err, w)
+			return
+		}
+
+		b, _ := json.Marshal(metaData)
+		w.Write(b)
+	}
+
+	if v.RestartPolicy != "" {
+		metaData, err := minivmm.SetVMRestartPolicy(vmName, v.RestartPolicy)
+		if err != nil {
+			writeInternalServerError(err, w)
+			return
+		}
+
+		b, _ := json.Marshal(metaData)
+		w.Write(b)
+	}
+
 	if v.Lock != "" {
 		var metaData *minivmm.VMMetaData
 		if v.Lock == "true" {
@@ -216,12 +368,18 @@ func RemoveVM(w http.ResponseWriter, r *http.Request) {
 }
 
 func resizeVM(vmName string, v *vm) (*minivmm.VMMetaData, error) {
-	err := minivmm.StopVM(vmName)
+	metaData, err := minivmm.HotplugResizeVM(vmName, v.CPU, v.Memory, v.Disk)
+	if err != minivmm.ErrHotplugUnsupported {
+		return metaData, err
+	}
+
+	// fall back to restart the VM
+	err = minivmm.StopVM(vmName)
 	if err != nil {
 		return nil, err
 	}
 
-	metaData, err := minivmm.ResizeVM(vmName, v.CPU, v.Memory, v.Disk)
+	metaData, err = minivmm.ResizeVM(vmName, v.CPU, v.Memory, v.Disk)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,101 @@
+package minivmm
+
+import (
+	"log"
+
+	"github.com/pkg/errors"
+)
+
+// archSpec is the QEMU settings for a guest architecture.
+type archSpec struct {
+	// Binary is the QEMU system emulator for the architecture.
+	Binary string
+	// Machine is the machine type. If empty, QEMU's default machine is used.
+	Machine string
+	// CPUModel is the CPU model used on TCG.
+	CPUModel string
+	// FirmwareParams are the parameters to load the firmware.
+	FirmwareParams []string
+	// TPMDevice is the TPM frontend device. If empty, TPM is not supported.
+	TPMDevice string
+}
+
+var archSpecs = map[string]archSpec{
+	"x86_64": {
+		Binary:    "qemu-system-x86_64",
+		CPUModel:  "max",
+		TPMDevice: "tpm-tis",
+	},
+	"aarch64": {
+		Binary:         "qemu-system-aarch64",
+		Machine:        "virt",
+		CPUModel:       "max",
+		FirmwareParams: []string{"-bios", "/usr/share/qemu-efi-aarch64/QEMU_EFI.fd"},
+		TPMDevice:      "tpm-tis-device",
+	},
+	"riscv64": {
+		Binary:         "qemu-system-riscv64",
+		Machine:        "virt",
+		CPUModel:       "rv64",
+		FirmwareParams: []string{"-kernel", "/usr/lib/u-boot/qemu-riscv64_smode/uboot.elf"},
+	},
+	"ppc64le": {
+		Binary:    "qemu-system-ppc64",
+		Machine:   "pseries",
+		CPUModel:  "power9",
+		TPMDevice: "tpm-spapr",
+	},
+}
+
+func getArchSpec(arch string) (archSpec, error) {
+	spec, ok := archSpecs[arch]
+	if !ok {
+		return archSpec{}, errors.Errorf("unsupported architecture '%s'", arch)
+	}
+	return spec, nil
+}
+
+// isKVMAvailable reports whether the VM of the architecture can be accelerated by KVM on this host.
+func isKVMAvailable(arch string) bool {
+	if C.NoKvm {
+		return false
+	}
+	hostArch, err := getMachineArch()
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	return hostArch == arch
+}
+
+// resolveVMArch decides the architecture of a new VM from the requested one and the image's one.
+func resolveVMArch(arch, imageName string) (string, error) {
+	imageArch := ""
+	if imageName != "" {
+		imageMetaData, err := GetImageMetaData(imageName)
+		if err != nil {
+			return "", err
+		}
+		imageArch = imageMetaData.Arch
+	}
+
+	if arch == "" {
+		arch = imageArch
+	}
+	if arch == "" {
+		hostArch, err := getMachineArch()
+		if err != nil {
+			log.Println(err)
+			hostArch = "x86_64"
+		}
+		arch = hostArch
+	}
+
+	if _, err := getArchSpec(arch); err != nil {
+		return "", err
+	}
+	if imageArch != "" && imageArch != arch {
+		return "", errors.Errorf("the image '%s' is for '%s', not for '%s'", imageName, imageArch, arch)
+	}
+	return arch, nil
+}
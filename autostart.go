@@ -0,0 +1,143 @@
+package minivmm
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Autostart policies of VM.
+const (
+	AutostartNever            = "never"
+	AutostartAlways           = "always"
+	AutostartRestoreLastState = "restore-last-state"
+)
+
+func isValidAutostartPolicy(policy string) bool {
+	switch policy {
+	case AutostartNever, AutostartAlways, AutostartRestoreLastState:
+		return true
+	}
+	return false
+}
+
+// shouldAutostart reports whether the VM should be started on host boot.
+func shouldAutostart(metaData *VMMetaData) bool {
+	switch metaData.Autostart {
+	case AutostartAlways:
+		return true
+	case AutostartRestoreLastState:
+		return metaData.LastStatus == "running" || metaData.LastStatus == "paused"
+	}
+	return false
+}
+
+// SetVMAutostart updates the autostart policy and order of VM. An empty value is left unchanged.
+func SetVMAutostart(name, policy, order string) (*VMMetaData, error) {
+	metaData, err := GetVM(name)
+	if err != nil {
+		return nil, errors.Wrap(err, "SetVMAutostart: Failed to get VM metadata")
+	}
+
+	if policy != "" {
+		if !isValidAutostartPolicy(policy) {
+			return nil, errors.Errorf("SetVMAutostart: invalid autostart policy '%s'", policy)
+		}
+		metaData.Autostart = policy
+	}
+	if order != "" {
+		o, err := strconv.Atoi(order)
+		if err != nil {
+			return nil, errors.Wrap(err, "SetVMAutostart: invalid autostart order")
+		}
+		metaData.AutostartOrder = o
+	}
+
+	err = saveVMMetaData(name, metaData)
+	if err != nil {
+		return nil, err
+	}
+
+	return metaData, nil
+}
+
+var (
+	bootIDPath         = "/proc/sys/kernel/random/boot_id"
+	lastBootIDFileName = "boot_id"
+)
+
+// isFirstRunSinceBoot reports whether minivmm runs for the first time since the host boot, and records the boot.
+// The daemon restarts on the same boot must not start the VMs stopped by users.
+func isFirstRunSinceBoot() (bool, error) {
+	bootID, err := os.ReadFile(bootIDPath)
+	if err != nil {
+		return false, err
+	}
+	lastBootIDPath := filepath.Join(C.Dir, lastBootIDFileName)
+	lastBootID, err := os.ReadFile(lastBootIDPath)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	if bytes.Equal(bootID, lastBootID) {
+		return false, nil
+	}
+	// recorded before starting VMs, so that VMs are not started twice even if minivmm restarts during autostart
+	err = os.WriteFile(lastBootIDPath, bootID, 0644)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// AutostartVMs starts VMs according to their autostart policy on the first run since the host boot.
+// VMs are started in ascending order of the autostart order with the configured delay between them.
+func AutostartVMs() {
+	first, err := isFirstRunSinceBoot()
+	if err != nil {
+		log.Println("[autostart] WARN failed to check host boot:", err)
+		return
+	}
+	if !first {
+		log.Println("[autostart] INFO skipped because the host has not rebooted")
+		return
+	}
+
+	vms, err := ListVMs()
+	if err != nil {
+		log.Println("[autostart] WARN failed to list VMs:", err)
+		return
+	}
+
+	targets := []*VMMetaData{}
+	for _, vm := range vms {
+		if vm.Status != "stopped" && vm.Status != "suspended" {
+			continue
+		}
+		if shouldAutostart(vm) {
+			targets = append(targets, vm)
+		}
+	}
+	sort.SliceStable(targets, func(i, j int) bool {
+		if targets[i].AutostartOrder != targets[j].AutostartOrder {
+			return targets[i].AutostartOrder < targets[j].AutostartOrder
+		}
+		return targets[i].Name < targets[j].Name
+	})
+
+	for i, vm := range targets {
+		if i > 0 {
+			time.Sleep(C.AutostartDelay)
+		}
+		log.Printf("[autostart] INFO starting %s (%s)\n", vm.Name, vm.Autostart)
+		_, err := StartVM(vm.Name)
+		if err != nil {
+			log.Printf("[autostart] WARN failed to start %s: %v\n", vm.Name, err)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package minivmm
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/yaamai/govmm/qemu"
+)
+
+var (
+	balloonDevicePath = "/machine/peripheral/balloon0"
+	// interval in seconds for the guest to report its memory statistics
+	balloonStatsInterval = 10
+)
+
+// VMMemoryStats is the guest memory statistics reported by the balloon driver.
+// The statistics the guest does not report are -1.
+type VMMemoryStats struct {
+	ActualBytes    int64 `json:"actual_bytes"`
+	TotalBytes     int64 `json:"total_bytes"`
+	FreeBytes      int64 `json:"free_bytes"`
+	AvailableBytes int64 `json:"available_bytes"`
+	CachedBytes    int64 `json:"cached_bytes"`
+}
+
+// enableBalloonStats asks the guest balloon driver to report its memory statistics periodically.
+func enableBalloonStats(q *qemu.QMP) error {
+	return executeQMPCommand(q, "qom-set", map[string]interface{}{
+		"path":     balloonDevicePath,
+		"property": "guest-stats-polling-interval",
+		"value":    balloonStatsInterval,
+	}, nil)
+}
+
+func setBalloonTarget(q *qemu.QMP, target string) error {
+	bytes, err := ConvertSIPrefixedValue(target, "")
+	if err != nil {
+		return err
+	}
+	value, err := strconv.ParseUint(bytes, 10, 64)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return q.ExecuteBalloon(ctx, value)
+}
+
+// setupBalloon enables the memory statistics and restores the target memory of the VM just started.
+func setupBalloon(name string, metaData *VMMetaData) {
+	if !getHardware(metaData).Balloon {
+		return
+	}
+	err := withQMP(name, func(q *qemu.QMP) error {
+		err := enableBalloonStats(q)
+		if err != nil {
+			return err
+		}
+		if metaData.TargetMemory != "" {
+			return setBalloonTarget(q, metaData.TargetMemory)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("Ignore setupBalloon error:", err)
+	}
+}
+
+// SetVMTargetMemory sets the memory size which the guest is asked to shrink to. If target is "0", the target
+// is reset to the VM's memory size.
+func SetVMTargetMemory(name, target string) (*VMMetaData, error) {
+	metaData, err := GetVM(name)
+	if err != nil {
+		return nil, errors.Wrap(err, "SetVMTargetMemory: Failed to get VM metadata")
+	}
+	if !getHardware(metaData).Balloon {
+		return nil, errors.New("SetVMTargetMemory: the VM has no balloon device")
+	}
+
+	if target == "0" {
+		target = ""
+	}
+	if target != "" {
+		t, err := convertMebi(target)
+		if err != nil {
+			return nil, err
+		}
+		mem, err := convertMebi(metaData.Memory)
+		if err != nil {
+			return nil, err
+		}
+		if t > mem {
+			return nil, errors.Errorf("SetVMTargetMemory: target %s exceeds memory %s", target, metaData.Memory)
+		}
+	}
+
+	if metaData.Status == "running" || metaData.Status == "paused" {
+		err = withQMP(name, func(q *qemu.QMP) error {
+			if target == "" {
+				return setBalloonTarget(q, metaData.Memory)
+			}
+			return setBalloonTarget(q, target)
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "SetVMTargetMemory: balloon failed")
+		}
+	}
+
+	metaData.TargetMemory = target
+	err = saveVMMetaData(name, metaData)
+	if err != nil {
+		return nil, err
+	}
+	return metaData, nil
+}
+
+// queryVMMemoryStats returns the guest memory statistics of the running VM.
+func queryVMMemoryStats(q *qemu.QMP) (*VMMemoryStats, error) {
+	stats := &VMMemoryStats{}
+
+	var balloon struct {
+		Actual int64 `json:"actual"`
+	}
+	err := executeQMPCommand(q, "query-balloon", nil, &balloon)
+	if err != nil {
+		return nil, err
+	}
+	stats.ActualBytes = balloon.Actual
+
+	var guestStats struct {
+		Stats      map[string]int64 `json:"stats"`
+		LastUpdate int64            `json:"last-update"`
+	}
+	err = executeQMPCommand(q, "qom-get", map[string]interface{}{"path": balloonDevicePath, "property": "guest-stats"}, &guestStats)
+	if err != nil {
+		return nil, err
+	}
+	if guestStats.LastUpdate == 0 {
+		// the polling is lost when the VM was started by older versions
+		err = enableBalloonStats(q)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	stat := func(key string) int64 {
+		if v, ok := guestStats.Stats[key]; ok && guestStats.LastUpdate != 0 {
+			return v
+		}
+		return -1
+	}
+	stats.TotalBytes = stat("stat-total-memory")
+	stats.FreeBytes = stat("stat-free-memory")
+	stats.AvailableBytes = stat("stat-available-memory")
+	stats.CachedBytes = stat("stat-disk-caches")
+	return stats, nil
+}
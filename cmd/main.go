@@ -48,6 +48,7 @@ func ensureDir() error {
 	dirs := []string{
 		filepath.Join(minivmm.C.Dir, "forwards"),
 		filepath.Join(minivmm.C.Dir, "images"),
+		filepath.Join(minivmm.C.Dir, "networks"),
 		filepath.Join(minivmm.C.Dir, "vms"),
 	}
 	for _, dir := range dirs {
@@ -114,6 +115,8 @@ func server() {
 
 	go minivmm.ServeDHCP()
 	go minivmm.UpdateIPAddress()
+	go minivmm.ReconcileVMStatus()
+	go minivmm.AutostartVMs()
 
 	log.Println("Starting minivm..")
 	if minivmm.C.NoTLS {
@@ -2,6 +2,7 @@ package minivmm
 
 import (
 	"path/filepath"
+	"time"
 
 	"github.com/caarlos0/env"
 )
@@ -23,10 +24,30 @@ type Config struct {
 	NoAuth            bool     `env:"VMM_NO_AUTH" envDefault:"false"`
 	NoKvm             bool     `env:"VMM_NO_KVM" envDefault:"false"`
 	VNCKeyboardLayout string   `env:"VMM_VNC_KEYBOARD_LAYOUT" envDefault:"en-us"`
+	NoNAT             bool     `env:"VMM_NO_NAT" envDefault:"false"`
+	NftDryRun         bool     `env:"VMM_NFT_DRY_RUN" envDefault:"false"`
+	EgressAllow       []string `env:"VMM_EGRESS_ALLOW" envSeparator:","`
+	EgressDeny        []string `env:"VMM_EGRESS_DENY" envSeparator:","`
+	ForwardBackend    string   `env:"VMM_FORWARD_BACKEND" envDefault:"proxy"`
+
+	AutostartDelay time.Duration `env:"VMM_AUTOSTART_DELAY" envDefault:"10s"`
+
+	CPUOvercommitRatio    float64 `env:"VMM_CPU_OVERCOMMIT_RATIO" envDefault:"0"`
+	MemoryOvercommitRatio float64 `env:"VMM_MEMORY_OVERCOMMIT_RATIO" envDefault:"0"`
+	DiskOvercommitRatio   float64 `env:"VMM_DISK_OVERCOMMIT_RATIO" envDefault:"0"`
+
+	OVMFCode           string `env:"VMM_OVMF_CODE" envDefault:"/usr/share/OVMF/OVMF_CODE.fd"`
+	OVMFVars           string `env:"VMM_OVMF_VARS" envDefault:"/usr/share/OVMF/OVMF_VARS.fd"`
+	OVMFSecureBootCode string `env:"VMM_OVMF_SECURE_BOOT_CODE" envDefault:"/usr/share/OVMF/OVMF_CODE.secboot.fd"`
+	OVMFSecureBootVars string `env:"VMM_OVMF_SECURE_BOOT_VARS" envDefault:"/usr/share/OVMF/OVMF_VARS.ms.fd"`
+	AAVMFCode          string `env:"VMM_AAVMF_CODE" envDefault:"/usr/share/AAVMF/AAVMF_CODE.fd"`
+	AAVMFVars          string `env:"VMM_AAVMF_VARS" envDefault:"/usr/share/AAVMF/AAVMF_VARS.fd"`
 
 	VMDir      string
 	ImageDir   string
 	ForwardDir string
+	NetworkDir string
+	QuotaFile  string
 }
 
 // C is a global configuration object.
@@ -41,6 +62,8 @@ func ParseConfig() error {
 	c.VMDir = filepath.Join(c.Dir, "vms")
 	c.ImageDir = filepath.Join(c.Dir, "images")
 	c.ForwardDir = filepath.Join(c.Dir, "forwards")
+	c.NetworkDir = filepath.Join(c.Dir, "networks")
+	c.QuotaFile = filepath.Join(c.Dir, "quotas.json")
 
 	C = &c
 	return nil
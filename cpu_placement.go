@@ -0,0 +1,251 @@
+package minivmm
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// maxCPUs is the number of CPUs which sched_setaffinity can handle.
+var maxCPUs = len(unix.CPUSet{}) * 64
+
+var onlineCPUsPath = "/sys/devices/system/cpu/online"
+
+// parseCPUList parses a list of CPUs in the Linux cpulist format like "0-3,8".
+func parseCPUList(list string) ([]int, error) {
+	cpus := []int{}
+	if strings.TrimSpace(list) == "" {
+		return cpus, nil
+	}
+	for _, r := range strings.Split(list, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(r), "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, errors.Errorf("invalid cpu list '%s'", list)
+		}
+		last := first
+		if len(bounds) == 2 {
+			last, err = strconv.Atoi(bounds[1])
+			if err != nil {
+				return nil, errors.Errorf("invalid cpu list '%s'", list)
+			}
+		}
+		if first < 0 || last < first {
+			return nil, errors.Errorf("invalid cpu list '%s'", list)
+		}
+		if last >= maxCPUs {
+			return nil, errors.Errorf("cpu %d in '%s' exceeds the maximum %d", last, list, maxCPUs-1)
+		}
+		for c := first; c <= last; c++ {
+			cpus = append(cpus, c)
+		}
+	}
+	return cpus, nil
+}
+
+// validateCPUTopology checks the topology matches the maximum number of vCPUs.
+func validateCPUTopology(cpu string, spec CPUSpec) error {
+	n, err := strconv.Atoi(cpu)
+	if err != nil {
+		return errors.Errorf("invalid cpu '%s'", cpu)
+	}
+	if spec.MaxCPUs > 0 {
+		if spec.MaxCPUs < n {
+			return errors.Errorf("max cpus %d is less than %d vCPUs", spec.MaxCPUs, n)
+		}
+		n = spec.MaxCPUs
+	}
+	if spec.Sockets == 0 || spec.Cores == 0 || spec.Threads == 0 {
+		return nil
+	}
+	if spec.Sockets*spec.Cores*spec.Threads != n {
+		return errors.Errorf("topology %dx%dx%d does not match %d vCPUs", spec.Sockets, spec.Cores, spec.Threads, n)
+	}
+	return nil
+}
+
+func getNUMANodePath(node string) string {
+	return filepath.Join("/sys/devices/system/node", "node"+node)
+}
+
+// getOnlineCPUs returns the host CPUs which are online. They are not always contiguous.
+func getOnlineCPUs() (map[int]bool, error) {
+	b, err := os.ReadFile(onlineCPUsPath)
+	if err != nil {
+		return nil, err
+	}
+	cpus, err := parseCPUList(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, err
+	}
+	online := map[int]bool{}
+	for _, c := range cpus {
+		online[c] = true
+	}
+	return online, nil
+}
+
+// validateCPUPlacement checks the pinned CPUs are online and the NUMA node exists on this host.
+func validateCPUPlacement(spec CPUSpec) error {
+	cpus, err := parseCPUList(spec.Pinning)
+	if err != nil {
+		return err
+	}
+	if len(cpus) > 0 {
+		online, err := getOnlineCPUs()
+		if err != nil {
+			return errors.Wrap(err, "failed to get online cpus")
+		}
+		for _, c := range cpus {
+			if !online[c] {
+				return errors.Errorf("host cpu %d is not online", c)
+			}
+		}
+	}
+
+	if spec.NUMANode != "" {
+		if _, err := strconv.Atoi(spec.NUMANode); err != nil {
+			return errors.Errorf("invalid numa node '%s'", spec.NUMANode)
+		}
+		if !exists(getNUMANodePath(spec.NUMANode)) {
+			return errors.Errorf("numa node %s does not exist", spec.NUMANode)
+		}
+	}
+	return nil
+}
+
+// pinVCPUs pins each vCPU thread of the running VM to the host CPU in the pinning list in order.
+func pinVCPUs(name string, spec CPUSpec) error {
+	cpus, err := parseCPUList(spec.Pinning)
+	if err != nil || len(cpus) == 0 {
+		return err
+	}
+
+	q, disconnectedCh, err := initQMP(getQMPSocketPath(name))
+	if err != nil {
+		return errors.Wrap(err, "pinVCPUs: QMP connection cannot established")
+	}
+	defer func() {
+		q.Shutdown()
+		<-disconnectedCh
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	vcpus, err := q.ExecQueryCpusFast(ctx)
+	cancel()
+	if err != nil {
+		return errors.Wrap(err, "pinVCPUs: query-cpus-fast failed")
+	}
+
+	for _, vcpu := range vcpus {
+		var set unix.CPUSet
+		set.Set(cpus[vcpu.CPUIndex%len(cpus)])
+		err = unix.SchedSetaffinity(vcpu.ThreadID, &set)
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("pinVCPUs: failed to pin vCPU %d", vcpu.CPUIndex))
+		}
+	}
+	log.Printf("[cpu] INFO pinned vCPUs of %s to %v\n", name, cpus)
+	return nil
+}
+
+// mergeCPUSpec returns the spec whose fields are overwritten by the non-zero fields of update.
+func mergeCPUSpec(spec, update CPUSpec) CPUSpec {
+	if update.Model != "" {
+		spec.Model = update.Model
+	}
+	if update.Sockets != 0 {
+		spec.Sockets = update.Sockets
+	}
+	if update.Cores != 0 {
+		spec.Cores = update.Cores
+	}
+	if update.Threads != 0 {
+		spec.Threads = update.Threads
+	}
+	if update.MaxCPUs != 0 {
+		spec.MaxCPUs = update.MaxCPUs
+	}
+	if update.Pinning != "" {
+		spec.Pinning = update.Pinning
+	}
+	if update.NUMANode != "" {
+		spec.NUMANode = update.NUMANode
+	}
+	return spec
+}
+
+// UpdateVMCPU updates the CPU model, topology and placement of VM. Only the non-zero fields of update are changed.
+// The pinning is applied to the running VM immediately, and the others are applied on the next start.
+func UpdateVMCPU(name string, update CPUSpec) (*VMMetaData, error) {
+	metaData, err := GetVM(name)
+	if err != nil {
+		return nil, errors.Wrap(err, "UpdateVMCPU: Failed to get VM metadata")
+	}
+	if metaData.Hardware == nil {
+		metaData.Hardware = newLegacyHardware()
+	}
+	spec := mergeCPUSpec(metaData.Hardware.CPU, update)
+	err = validateCPUTopology(metaData.CPU, spec)
+	if err != nil {
+		return nil, err
+	}
+	err = validateCPUPlacement(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	// only the pinning is applied without changing the command line
+	cur := metaData.Hardware.CPU
+	cur.Pinning = spec.Pinning
+	if cur != spec {
+		switch metaData.Status {
+		case "suspended":
+			return nil, errors.New("Cannot change CPU model, topology or NUMA node of suspended VM")
+		case "running", "paused":
+			metaData.DevicesChanged = true
+		}
+	}
+
+	metaData.Hardware.CPU = spec
+	err = saveVMMetaData(name, metaData)
+	if err != nil {
+		return nil, err
+	}
+
+	if metaData.Status == "running" || metaData.Status == "paused" {
+		err = pinVCPUs(name, spec)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return metaData, nil
+}
+
+// getNUMANodeMemory returns the total memory bytes of the host NUMA node.
+func getNUMANodeMemory(node string) (uint64, error) {
+	b, err := os.ReadFile(filepath.Join(getNUMANodePath(node), "meminfo"))
+	if err != nil {
+		return 0, err
+	}
+	// e.g. "Node 0 MemTotal:       32768000 kB"
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 4 && fields[2] == "MemTotal:" {
+			kb, err := strconv.ParseUint(fields[3], 10, 64)
+			if err != nil {
+				return 0, err
+			}
+			return kb * 1024, nil
+		}
+	}
+	return 0, errors.Errorf("MemTotal of numa node %s is not found", node)
+}
@@ -5,6 +5,7 @@ import (
 	"math/rand"
 	"net"
 	"strings"
+	"sync"
 	"time"
 
 	dhcp "github.com/krolaw/dhcp4"
@@ -25,33 +26,66 @@ func parseNameServers() []byte {
 	return addresses
 }
 
-// ServeDHCP serves DHCP.
+// ServeDHCP serves DHCP on all networks.
 func ServeDHCP() {
-	nwInfo, err := newNetworkInfo()
+	networks, err := ListNetworks()
 	if err != nil {
 		log.Fatal(err)
 	}
+	for _, n := range networks {
+		if n.Name == DefaultNetworkName {
+			continue
+		}
+		go func(n *Network) {
+			err := serveNetworkDHCP(n)
+			if err != nil {
+				log.Printf("[dhcp] WARN %s: %v\n", n.Name, err)
+			}
+		}(n)
+	}
+	log.Fatal(serveNetworkDHCP(defaultNetwork()))
+}
+
+// serveNetworkDHCP serves DHCP on the network until stopNetworkDHCP is called.
+func serveNetworkDHCP(n *Network) error {
+	nwInfo, err := getNetworkInfo(n)
+	if err != nil {
+		return err
+	}
 
 	dnsIPs := parseNameServers()
 	handler := &dhcpHandler{
 		ip:            nwInfo.gwIP,
 		start:         nwInfo.startIP,
-		leaseRange:    (1 << uint(32-nwInfo.cidrLen)) - 4,
+		leaseRange:    nwInfo.leaseRange,
 		leaseDuration: 2 * time.Hour,
 		leases:        make(map[int]lease, 32),
+		reserved:      make(map[int]string),
+		leaseFile:     getLeaseFilePathOf(n.Name),
+		network:       n.Name,
 		macVendor:     "52:54:00",
 		options: dhcp.Options{
 			dhcp.OptionSubnetMask:       []byte(nwInfo.cidrIPNet.Mask),
-			dhcp.OptionRouter:           []byte(nwInfo.gwIP),
 			dhcp.OptionDomainNameServer: dnsIPs,
 		},
 	}
+	if nwInfo.router {
+		handler.options[dhcp.OptionRouter] = []byte(nwInfo.gwIP)
+	}
+
+	err = handler.loadLeases()
+	if err != nil {
+		return err
+	}
 
-	pc, err := conn.NewUDP4BoundListener(vethNames[0], ":67")
+	pc, err := conn.NewUDP4BoundListener(nwInfo.veth[0], ":67")
 	if err != nil {
-		panic(err)
+		return err
 	}
-	log.Fatal(dhcp.Serve(pc, handler))
+	handler.pc = pc
+	registerDHCPHandler(n.Name, handler)
+	defer unregisterDHCPHandler(n.Name, handler)
+	return dhcp.Serve(pc, handler)
 }
 
 type lease struct {
@@ -60,16 +94,24 @@ type lease struct {
 }
 
 type dhcpHandler struct {
-	ip            net.IP        // Server IP to use
-	options       dhcp.Options  // Options to send to DHCP Clients
-	start         net.IP        // Start of IP range to distribute
-	leaseRange    int           // Number of IPs to distribute (starting from start)
-	leaseDuration time.Duration // Lease period
-	leases        map[int]lease // Map to keep track of leases
+	ip            net.IP         // Server IP to use
+	options       dhcp.Options   // Options to send to DHCP Clients
+	start         net.IP         // Start of IP range to distribute
+	leaseRange    int            // Number of IPs to distribute (starting from start)
+	leaseDuration time.Duration  // Lease period
+	leases        map[int]lease  // Map to keep track of leases
+	reserved      map[int]string // Map of static IP addresses to the MAC addresses
+	leaseFile     string         // File to persist leases
+	network       string         // Name of the network to serve
+	pc            net.PacketConn // Connection to stop serving
 	macVendor     string
+	mu            sync.Mutex
 }
 
 func (h *dhcpHandler) ServeDHCP(p dhcp.Packet, msgType dhcp.MessageType, options dhcp.Options) (d dhcp.Packet) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
 	switch msgType {
 
 	case dhcp.Discover:
@@ -79,6 +121,9 @@ func (h *dhcpHandler) ServeDHCP(p dhcp.Packet, msgType dhcp.MessageType, options
 			return
 		}
 		free, nic := -1, p.CHAddr().String()
+		if free = h.reservedLease(nic); free != -1 {
+			goto reply
+		}
 		for i, v := range h.leases { // Find previous lease
 			if v.nic == nic {
 				free = i
@@ -104,14 +149,27 @@ func (h *dhcpHandler) ServeDHCP(p dhcp.Packet, msgType dhcp.MessageType, options
 
 		if len(reqIP) == 4 && !reqIP.Equal(net.IPv4zero) {
 			if leaseNum := dhcp.IPRange(h.start, reqIP) - 1; leaseNum >= 0 && leaseNum < h.leaseRange {
-				if l, exists := h.leases[leaseNum]; !exists || l.nic == p.CHAddr().String() {
+				nic := p.CHAddr().String()
+				if owner, ok := h.reserved[leaseNum]; ok && owner != nic {
+					log.Println("[dhcp] WARN requested address is reserved by another VM")
+					return dhcp.ReplyPacket(p, dhcp.NAK, h.ip, nil, 0, nil)
+				}
+				if r := h.reservedLease(nic); r != -1 && r != leaseNum {
+					// make the client discover its static address
+					return dhcp.ReplyPacket(p, dhcp.NAK, h.ip, nil, 0, nil)
+				}
+				if l, exists := h.leases[leaseNum]; !exists || l.nic == nic || h.reserved[leaseNum] == nic {
 					// update VM metadata
 					VMIPAddressUpdateChan <- &VMMetaData{
 						IPAddress:  reqIP.String(),
 						MacAddress: p.CHAddr().String(),
 					}
 					// lease
-					h.leases[leaseNum] = lease{nic: p.CHAddr().String(), expiry: time.Now().Add(h.leaseDuration)}
+					h.leases[leaseNum] = lease{nic: nic, expiry: time.Now().Add(h.leaseDuration)}
+					err := h.saveLeases()
+					if err != nil {
+						log.Println("Ignore saveLeases error:", err)
+					}
 					return dhcp.ReplyPacket(p, dhcp.ACK, h.ip, reqIP, h.leaseDuration,
 						h.options.SelectOrderOrAll(options[dhcp.OptionParameterRequestList]))
 				}
@@ -127,6 +185,10 @@ func (h *dhcpHandler) ServeDHCP(p dhcp.Packet, msgType dhcp.MessageType, options
 				break
 			}
 		}
+		err := h.saveLeases()
+		if err != nil {
+			log.Println("Ignore saveLeases error:", err)
+		}
 	}
 	return nil
 }
@@ -136,6 +198,9 @@ func (h *dhcpHandler) freeLease() int {
 	b := rand.Intn(h.leaseRange) // Try random first
 	for _, v := range [][]int{[]int{b, h.leaseRange}, []int{0, b}} {
 		for i := v[0]; i < v[1]; i++ {
+			if _, ok := h.reserved[i]; ok {
+				continue
+			}
 			if l, ok := h.leases[i]; !ok || l.expiry.Before(now) {
 				return i
 			}
@@ -0,0 +1,274 @@
+package minivmm
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	dhcp "github.com/krolaw/dhcp4"
+	"github.com/pkg/errors"
+)
+
+const leaseFileName = "dhcp_leases.json"
+
+var (
+	// activeDHCPHandlers are the handlers of the running DHCP servers by network, to reserve IP addresses
+	// of VMs created later.
+	activeDHCPHandlers   = map[string]*dhcpHandler{}
+	activeDHCPHandlersMu sync.Mutex
+)
+
+type leaseRecord struct {
+	MacAddress string    `json:"mac_address"`
+	IPAddress  string    `json:"ip_address"`
+	Expiry     time.Time `json:"expiry"`
+	Static     bool      `json:"static"`
+}
+
+func getLeaseFilePathOf(network string) string {
+	if network == DefaultNetworkName {
+		return filepath.Join(C.Dir, leaseFileName)
+	}
+	return filepath.Join(C.Dir, fmt.Sprintf("dhcp_leases-%s.json", network))
+}
+
+func registerDHCPHandler(network string, h *dhcpHandler) {
+	activeDHCPHandlersMu.Lock()
+	defer activeDHCPHandlersMu.Unlock()
+	activeDHCPHandlers[network] = h
+}
+
+func unregisterDHCPHandler(network string, h *dhcpHandler) {
+	activeDHCPHandlersMu.Lock()
+	defer activeDHCPHandlersMu.Unlock()
+	if activeDHCPHandlers[network] == h {
+		delete(activeDHCPHandlers, network)
+	}
+}
+
+func getDHCPHandler(network string) *dhcpHandler {
+	activeDHCPHandlersMu.Lock()
+	defer activeDHCPHandlersMu.Unlock()
+	return activeDHCPHandlers[network]
+}
+
+// stopNetworkDHCP stops serving DHCP on the network.
+func stopNetworkDHCP(network string) {
+	h := getDHCPHandler(network)
+	if h == nil {
+		return
+	}
+	err := h.pc.Close()
+	if err != nil {
+		log.Println("Ignore Close error:", err)
+	}
+}
+
+// getLeaseNum returns the index of the IP address in the DHCP range, or -1 if it's out of the range.
+func getLeaseNum(start net.IP, leaseRange int, ip string) int {
+	addr := net.ParseIP(ip).To4()
+	if addr == nil {
+		return -1
+	}
+	leaseNum := dhcp.IPRange(start, addr) - 1
+	if leaseNum < 0 || leaseNum >= leaseRange {
+		return -1
+	}
+	return leaseNum
+}
+
+// loadLeases restores the leases from the lease file and the VM metadata.
+func (h *dhcpHandler) loadLeases() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	leaseNum := func(ip string) int { return getLeaseNum(h.start, h.leaseRange, ip) }
+
+	vms, err := ListVMs()
+	if err != nil {
+		return err
+	}
+	vmMACs := map[string]bool{}
+	for _, vm := range vms {
+		for _, nic := range getVMNICs(vm) {
+			vmMACs[nic.MacAddress] = true
+		}
+	}
+
+	b, err := os.ReadFile(h.leaseFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		records := []leaseRecord{}
+		err = json.Unmarshal(b, &records)
+		if err != nil {
+			return errors.Wrap(err, "invalid lease file")
+		}
+		for _, r := range records {
+			i := leaseNum(r.IPAddress)
+			if i == -1 {
+				// the subnet has been changed
+				continue
+			}
+			h.leases[i] = lease{nic: r.MacAddress, expiry: r.Expiry}
+			// the reservations of removed VMs, or VMs failed to be created, are dropped
+			if r.Static && vmMACs[r.MacAddress] {
+				h.reserved[i] = r.MacAddress
+			}
+		}
+	}
+
+	// the VM metadata takes precedence because the lease file may be lost or stale
+	for _, vm := range vms {
+		for _, nic := range getVMNICs(vm) {
+			if nic.Network != h.network {
+				continue
+			}
+			if nic.StaticIPAddress != "" {
+				if i := leaseNum(nic.StaticIPAddress); i != -1 {
+					h.reserved[i] = nic.MacAddress
+				}
+			}
+			if nic.IPAddress == "" {
+				continue
+			}
+			i := leaseNum(nic.IPAddress)
+			if i == -1 {
+				continue
+			}
+			if l, ok := h.leases[i]; !ok || l.nic != nic.MacAddress {
+				h.leases[i] = lease{nic: nic.MacAddress, expiry: time.Now().Add(h.leaseDuration)}
+			}
+		}
+	}
+	return h.saveLeases()
+}
+
+// saveLeases writes the leases to the lease file. The caller must hold the lock.
+func (h *dhcpHandler) saveLeases() error {
+	records := []leaseRecord{}
+	for i, l := range h.leases {
+		_, static := h.reserved[i]
+		records = append(records, leaseRecord{
+			MacAddress: l.nic,
+			IPAddress:  dhcp.IPAdd(h.start, i).String(),
+			Expiry:     l.expiry,
+			Static:     static,
+		})
+	}
+	for i, nic := range h.reserved {
+		if _, ok := h.leases[i]; !ok {
+			records = append(records, leaseRecord{MacAddress: nic, IPAddress: dhcp.IPAdd(h.start, i).String(), Static: true})
+		}
+	}
+
+	b, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	tmp := h.leaseFile + ".tmp"
+	err = os.WriteFile(tmp, b, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, h.leaseFile)
+}
+
+// reserve pins the IP address of the lease number to the MAC address.
+func (h *dhcpHandler) reserve(nic string, leaseNum int) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if owner, ok := h.reserved[leaseNum]; ok && owner != nic {
+		return errors.Errorf("%s is reserved by another VM", dhcp.IPAdd(h.start, leaseNum))
+	}
+	if l, ok := h.leases[leaseNum]; ok && l.nic != nic && l.expiry.After(time.Now()) {
+		return errors.Errorf("%s is leased to another VM", dhcp.IPAdd(h.start, leaseNum))
+	}
+	h.reserved[leaseNum] = nic
+	return h.saveLeases()
+}
+
+// release removes the lease and the reservation of the MAC address.
+func (h *dhcpHandler) release(nic string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, l := range h.leases {
+		if l.nic == nic {
+			delete(h.leases, i)
+		}
+	}
+	for i, owner := range h.reserved {
+		if owner == nic {
+			delete(h.reserved, i)
+		}
+	}
+	return h.saveLeases()
+}
+
+// reservedLease returns the lease number reserved for the MAC address, or -1.
+func (h *dhcpHandler) reservedLease(nic string) int {
+	for i, owner := range h.reserved {
+		if owner == nic {
+			return i
+		}
+	}
+	return -1
+}
+
+// validateStaticIPAddress checks the IP address of the network can be pinned to a new VM.
+func validateStaticIPAddress(network, ip string) error {
+	n, err := GetNetwork(network)
+	if err != nil {
+		return err
+	}
+	nwInfo, err := getNetworkInfo(n)
+	if err != nil {
+		return err
+	}
+	if getLeaseNum(nwInfo.startIP, nwInfo.leaseRange, ip) == -1 {
+		return errors.Errorf("IP address '%s' is out of the DHCP range of %s", ip, n.CIDR)
+	}
+
+	vms, err := ListVMs()
+	if err != nil {
+		return err
+	}
+	for _, vm := range vms {
+		for _, nic := range getVMNICs(vm) {
+			if nic.Network == n.Name && (nic.StaticIPAddress == ip || nic.IPAddress == ip) {
+				return errors.Errorf("IP address '%s' is already used by '%s'", ip, vm.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// reserveIPAddress pins the IP address to the MAC address in the running DHCP server of the network.
+func reserveIPAddress(network, mac, ip string) error {
+	h := getDHCPHandler(network)
+	if h == nil {
+		// it's restored from the VM metadata when the DHCP server starts
+		return nil
+	}
+	return h.reserve(mac, getLeaseNum(h.start, h.leaseRange, ip))
+}
+
+// releaseIPAddress frees the IP address leased or reserved to the MAC address.
+func releaseIPAddress(network, mac string) {
+	h := getDHCPHandler(network)
+	if h == nil {
+		return
+	}
+	err := h.release(mac)
+	if err != nil {
+		log.Println("Ignore releaseIPAddress error:", err)
+	}
+}
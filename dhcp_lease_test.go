@@ -0,0 +1,94 @@
+package minivmm
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestDHCPHandler(dir string) *dhcpHandler {
+	return &dhcpHandler{
+		start:         net.ParseIP("192.168.200.1").To4(),
+		leaseRange:    252,
+		leaseDuration: time.Hour,
+		leases:        map[int]lease{},
+		reserved:      map[int]string{},
+		leaseFile:     filepath.Join(dir, leaseFileName),
+	}
+}
+
+func TestLeasePersistence(t *testing.T) {
+	dir := t.TempDir()
+	SetConfig(&Config{Dir: dir, VMDir: filepath.Join(dir, "vms")})
+	os.MkdirAll(C.VMDir, 0755)
+
+	err := saveVMMetaData("vm1", &VMMetaData{Name: "vm1", MacAddress: "52:54:00:00:00:02"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := newTestDHCPHandler(dir)
+	h.leases[9] = lease{nic: "52:54:00:00:00:01", expiry: time.Now().Add(time.Hour)}
+	err = h.reserve("52:54:00:00:00:02", 19)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// reserved by the VM failed to be created
+	err = h.reserve("52:54:00:00:00:04", 29)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = h.reserve("52:54:00:00:00:03", 9)
+	if err == nil {
+		t.Errorf("expected error on reserving the leased address")
+	}
+
+	restored := newTestDHCPHandler(dir)
+	err = restored.loadLeases()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.leases[9].nic != "52:54:00:00:00:01" {
+		t.Errorf("lease is not restored: %v", restored.leases)
+	}
+	if restored.reserved[19] != "52:54:00:00:00:02" {
+		t.Errorf("reservation is not restored: %v", restored.reserved)
+	}
+	if _, ok := restored.reserved[29]; ok {
+		t.Errorf("reservation of the MAC address not belonging to any VM is restored: %v", restored.reserved)
+	}
+	if restored.reservedLease("52:54:00:00:00:02") != 19 {
+		t.Errorf("reserved lease is not found")
+	}
+	for i := 0; i < 100; i++ {
+		if restored.freeLease() == 19 {
+			t.Fatalf("reserved address is handed out")
+		}
+	}
+
+	err = restored.release("52:54:00:00:00:02")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := restored.reserved[19]; ok {
+		t.Errorf("reservation is not released")
+	}
+}
+
+func TestGetLeaseNum(t *testing.T) {
+	start := net.ParseIP("192.168.200.1").To4()
+	for ip, expected := range map[string]int{
+		"192.168.200.1":   0,
+		"192.168.200.10":  9,
+		"192.168.200.252": 251,
+		"192.168.200.253": -1,
+		"192.168.201.1":   -1,
+		"invalid":         -1,
+	} {
+		if n := getLeaseNum(start, 252, ip); n != expected {
+			t.Errorf("getLeaseNum(%s) = %d, expected %d", ip, n, expected)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package minivmm
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// Firmware types of VM.
+const (
+	FirmwareBIOS           = "bios"
+	FirmwareUEFI           = "uefi"
+	FirmwareUEFISecureBoot = "uefi-secureboot"
+)
+
+var nvramFileName = "efivars.fd"
+
+func getNVRAMPath(name string) string {
+	return filepath.Join(C.VMDir, name, nvramFileName)
+}
+
+// getUEFIFirmwarePaths returns the paths of the UEFI code and the variable store template for the architecture.
+func getUEFIFirmwarePaths(arch string, secureBoot bool) (string, string, error) {
+	switch arch {
+	case "x86_64":
+		if secureBoot {
+			return C.OVMFSecureBootCode, C.OVMFSecureBootVars, nil
+		}
+		return C.OVMFCode, C.OVMFVars, nil
+	case "aarch64":
+		if secureBoot {
+			return "", "", errors.New("secure boot is not supported on aarch64")
+		}
+		return C.AAVMFCode, C.AAVMFVars, nil
+	}
+	return "", "", errors.Errorf("UEFI is not supported on '%s'", arch)
+}
+
+func validateFirmware(arch, firmware string) error {
+	switch firmware {
+	case "", FirmwareBIOS:
+		return nil
+	case FirmwareUEFI, FirmwareUEFISecureBoot:
+		_, _, err := getUEFIFirmwarePaths(arch, firmware == FirmwareUEFISecureBoot)
+		return err
+	}
+	return errors.Errorf("unknown firmware '%s'", firmware)
+}
+
+func copyFile(src, dst string) error {
+	s, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	d, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	_, err = io.Copy(d, s)
+	return err
+}
+
+// generateFirmwareParams returns QEMU parameters to load the firmware. For UEFI, the variable store
+// template is copied into the VM directory at the first time, so that each VM keeps its own boot entries.
+func generateFirmwareParams(name, arch, firmware string) ([]string, error) {
+	if firmware == "" || firmware == FirmwareBIOS {
+		spec, err := getArchSpec(arch)
+		if err != nil {
+			return nil, err
+		}
+		return spec.FirmwareParams, nil
+	}
+
+	secureBoot := firmware == FirmwareUEFISecureBoot
+	code, vars, err := getUEFIFirmwarePaths(arch, secureBoot)
+	if err != nil {
+		return nil, err
+	}
+
+	nvramPath := getNVRAMPath(name)
+	if !exists(nvramPath) {
+		err = copyFile(vars, nvramPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to copy UEFI variable store template")
+		}
+	}
+
+	params := []string{}
+	if secureBoot {
+		// the machine with SMM is selected by qemuParamsBuilder
+		params = append(params, "-global", "driver=cfi.pflash01,property=secure,value=on")
+	}
+	params = append(params, "-drive", fmt.Sprintf("if=pflash,format=raw,unit=0,readonly=on,file=%s", code))
+	params = append(params, "-drive", fmt.Sprintf("if=pflash,format=raw,unit=1,file=%s", nvramPath))
+	return params, nil
+}
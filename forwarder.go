@@ -10,6 +10,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
@@ -19,9 +20,28 @@ var (
 	stopChannels = make(map[string]chan struct{})
 
 	nameToIP   = map[string]string{}
+	nameToIPMu sync.Mutex
 	ipChannels = make(map[string]map[string]chan struct{})
 )
 
+func lookupIP(name string) (string, bool) {
+	nameToIPMu.Lock()
+	defer nameToIPMu.Unlock()
+	ip, ok := nameToIP[name]
+	return ip, ok
+}
+
+// copyNameToIP returns a snapshot of the VM addresses.
+func copyNameToIP() map[string]string {
+	nameToIPMu.Lock()
+	defer nameToIPMu.Unlock()
+	addresses := make(map[string]string, len(nameToIP))
+	for name, ip := range nameToIP {
+		addresses[name] = ip
+	}
+	return addresses
+}
+
 func proxyUDPStream(fromPort, toIP, toPort string) (*net.UDPConn, *net.UDPConn, error) {
 	laddr, err := net.ResolveUDPAddr("udp", ":"+fromPort)
 	if err != nil {
@@ -98,13 +118,24 @@ func isUDPBindable(port string) error {
 	return nil
 }
 
-func proxyTCPSession(src net.Conn, toIP, toPort string) {
+func proxyTCPSession(src net.Conn, toIP, toPort, proxyProtocol string) {
 	dst, err := net.Dial("tcp", toIP+":"+toPort)
 	if err != nil {
 		log.Println("[forwarder] WARN dial error: ", err.Error())
+		src.Close()
 		return
 	}
 
+	if proxyProtocol != "" {
+		err = writeProxyProtocolHeader(dst, proxyProtocol, src)
+		if err != nil {
+			log.Println("[forwarder] WARN PROXY protocol header error: ", err.Error())
+			src.Close()
+			dst.Close()
+			return
+		}
+	}
+
 	done := make(chan struct{})
 
 	go func() {
@@ -125,7 +156,7 @@ func proxyTCPSession(src net.Conn, toIP, toPort string) {
 	<-done
 }
 
-func proxyTCP(stopChan chan struct{}, fromPort, toName, toPort string) {
+func proxyTCP(stopChan chan struct{}, fromPort, toName, toPort, proxyProtocol string) {
 	ln, err := net.Listen("tcp", ":"+fromPort)
 	if err != nil {
 		log.Println("[forwarder] WARN listen error: ", err.Error())
@@ -162,7 +193,7 @@ func proxyTCP(stopChan chan struct{}, fromPort, toName, toPort string) {
 				log.Printf("[forwarder] WARN could not get IP address for %s\n", toName)
 				continue
 			}
-			go proxyTCPSession(conn, toIP, toPort)
+			go proxyTCPSession(conn, toIP, toPort, proxyProtocol)
 		case <-stopChan:
 			log.Println("[forwarder] INFO shutdown tcp proxy")
 			return
@@ -181,7 +212,7 @@ func isTCPBindable(port string) error {
 
 func resolveName(name string) (string, error) {
 	for i := 0; i < 10; i++ {
-		ip, ok := nameToIP[name]
+		ip, ok := lookupIP(name)
 		if ok {
 			return ip, nil
 		}
@@ -206,35 +237,85 @@ func deleteIPChannel(name, id string) {
 	delete(ipChannels[name], id)
 }
 
-// StartForward starts new forwarding.
-func StartForward(proto, fromPort, toName, toPort string) error {
-	id := generateForwardID(proto, fromPort)
+// StartForward starts new forwarding. If the nftables backend is not available, it falls back to the userspace proxy.
+func StartForward(f *ForwardMetaData) error {
+	// the values are rendered into the nftables ruleset and the file name of the forward
+	err := validateForward(f)
+	if err != nil {
+		return err
+	}
+	id := generateForwardID(f.Proto, f.FromPort)
+	err = validateProxyProtocol(f.Proto, f.ProxyProtocol)
+	if err != nil {
+		return err
+	}
+	backend, err := getForwardBackend(f)
+	if err != nil {
+		return err
+	}
 
-	ch := make(chan struct{})
-	if proto == "udp" {
-		if err := isUDPBindable(fromPort); err != nil {
+	if f.Proto == "udp" {
+		if err := isUDPBindable(f.FromPort); err != nil {
 			return errors.Wrap(err, "failed to bind to udp port")
 		}
-		go proxyUDP(ch, id, fromPort, toName, toPort)
 	} else {
-		if err := isTCPBindable(fromPort); err != nil {
+		if err := isTCPBindable(f.FromPort); err != nil {
 			return errors.Wrap(err, "failed to bind to tcp port")
 		}
-		go proxyTCP(ch, fromPort, toName, toPort)
+	}
+
+	if backend == ForwardBackendNftables {
+		err = startDNATForward(f)
+		if err == nil {
+			return nil
+		}
+		log.Printf("[forwarder] WARN %s: fall back to the proxy: %v\n", id, err)
+	}
+
+	ch := make(chan struct{})
+	if f.Proto == "udp" {
+		go proxyUDP(ch, id, f.FromPort, f.ToName, f.ToPort)
+	} else {
+		go proxyTCP(ch, f.FromPort, f.ToName, f.ToPort, f.ProxyProtocol)
 	}
 	stopChannels[id] = ch
 	return nil
 }
 
+func validatePort(port string) error {
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 || strconv.Itoa(n) != port {
+		return errors.Errorf("invalid port '%s'", port)
+	}
+	return nil
+}
+
+func validateForward(f *ForwardMetaData) error {
+	if f.Proto != "tcp" && f.Proto != "udp" {
+		return errors.Errorf("invalid protocol '%s'", f.Proto)
+	}
+	err := validatePort(f.FromPort)
+	if err != nil {
+		return err
+	}
+	return validatePort(f.ToPort)
+}
+
 // StopForward stop forwarding.
 func StopForward(proto, fromPort string) error {
 	id := generateForwardID(proto, fromPort)
 
+	ok, err := stopDNATForward(id)
+	if ok {
+		return err
+	}
+
 	c, ok := stopChannels[id]
 	if !ok {
 		return fmt.Errorf("unknown forwarding: %s", id)
 	}
 	c <- struct{}{}
+	delete(stopChannels, id)
 	return nil
 }
 
@@ -248,6 +329,11 @@ type ForwardMetaData struct {
 	ToPort      string `json:"to_port"`
 	Type        string `json:"type"`
 	Description string `json:"description"`
+	// Backend is the forwarding backend, "proxy" or "nftables". Empty means VMM_FORWARD_BACKEND.
+	Backend string `json:"backend"`
+	// ProxyProtocol is the PROXY protocol version, "v1" or "v2", sent before the data to tell the client address.
+	// Empty means it's disabled.
+	ProxyProtocol string `json:"proxy_protocol"`
 }
 
 func generateForwardID(proto, fromPort string) string {
@@ -271,9 +357,10 @@ func ResumeForwards() error {
 		return err
 	}
 	for _, f := range fws {
-		err := StartForward(f.Proto, f.FromPort, f.ToName, f.ToPort)
+		// a broken forward must not prevent the others from resuming
+		err := StartForward(f)
 		if err != nil {
-			return err
+			log.Printf("[forwarder] WARN skip %s: %v\n", generateForwardID(f.Proto, f.FromPort), err)
 		}
 	}
 
@@ -282,7 +369,10 @@ func ResumeForwards() error {
 
 // UpdateIPAddressInForwarder updates the IP address associated to VM.
 func UpdateIPAddressInForwarder(name, ip string) {
+	nameToIPMu.Lock()
 	nameToIP[name] = ip
+	nameToIPMu.Unlock()
+	updateDNATForwards(name)
 
 	channels, ok := ipChannels[name]
 	if !ok {
@@ -0,0 +1,138 @@
+package minivmm
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// ForwardBackendProxy relays connections in userspace.
+	ForwardBackendProxy = "proxy"
+	// ForwardBackendNftables translates the destination of packets in the kernel, which keeps client addresses.
+	ForwardBackendNftables = "nftables"
+
+	nftForwardTableName = "minivmm_forward"
+)
+
+var (
+	// dnatForwards are the forwards by the nftables backend by ID
+	dnatForwards   = map[string]*ForwardMetaData{}
+	dnatForwardsMu sync.Mutex
+)
+
+// getForwardBackend returns the backend of the forward, which defaults to the global one. The forwards with
+// PROXY protocol need the proxy backend because the header cannot be inserted by the kernel.
+func getForwardBackend(f *ForwardMetaData) (string, error) {
+	backend := f.Backend
+	if backend == "" && f.ProxyProtocol == "" {
+		backend = C.ForwardBackend
+	}
+	switch backend {
+	case "", ForwardBackendProxy:
+		return ForwardBackendProxy, nil
+	case ForwardBackendNftables:
+		if f.ProxyProtocol != "" {
+			return "", errors.New("PROXY protocol is not supported by the nftables backend")
+		}
+		return ForwardBackendNftables, nil
+	}
+	return "", errors.Errorf("unknown forward backend '%s'", backend)
+}
+
+// generateForwardRuleset renders the DNAT rules of the forwards. The forwards to VMs whose addresses are not
+// known yet are skipped, and they are added when the addresses are updated.
+func generateForwardRuleset(forwards []*ForwardMetaData, addresses map[string]string) string {
+	sorted := append([]*ForwardMetaData{}, forwards...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return generateForwardID(sorted[i].Proto, sorted[i].FromPort) < generateForwardID(sorted[j].Proto, sorted[j].FromPort)
+	})
+
+	rules := []string{}
+	for _, f := range sorted {
+		ip, ok := addresses[f.ToName]
+		if !ok || ip == "" {
+			continue
+		}
+		rules = append(rules, fmt.Sprintf("%s dport %s dnat to %s:%s", f.Proto, f.FromPort, ip, f.ToPort))
+	}
+
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "table ip %s\n", nftForwardTableName)
+	fmt.Fprintf(b, "delete table ip %s\n", nftForwardTableName)
+	fmt.Fprintf(b, "table ip %s {\n", nftForwardTableName)
+	fmt.Fprintf(b, "\tchain prerouting {\n\t\ttype nat hook prerouting priority -100; policy accept;\n")
+	for _, r := range rules {
+		fmt.Fprintf(b, "\t\tfib daddr type local %s\n", r)
+	}
+	fmt.Fprintf(b, "\t}\n")
+	// the connections from the host itself, except loopback ones which cannot be routed to VMs
+	fmt.Fprintf(b, "\tchain output {\n\t\ttype nat hook output priority -100; policy accept;\n")
+	for _, r := range rules {
+		fmt.Fprintf(b, "\t\tfib daddr type local ip daddr != 127.0.0.0/8 %s\n", r)
+	}
+	fmt.Fprintf(b, "\t}\n")
+	fmt.Fprintf(b, "}\n")
+	return b.String()
+}
+
+// applyForwardRules installs the DNAT rules of all forwards by the nftables backend. The caller must hold the lock.
+func applyForwardRules() error {
+	forwards := []*ForwardMetaData{}
+	for _, f := range dnatForwards {
+		forwards = append(forwards, f)
+	}
+	return runNft(generateForwardRuleset(forwards, copyNameToIP()))
+}
+
+// startDNATForward adds the forward to the nftables backend.
+func startDNATForward(f *ForwardMetaData) error {
+	dnatForwardsMu.Lock()
+	defer dnatForwardsMu.Unlock()
+
+	id := generateForwardID(f.Proto, f.FromPort)
+	dnatForwards[id] = f
+	err := applyForwardRules()
+	if err != nil {
+		delete(dnatForwards, id)
+		return err
+	}
+	return nil
+}
+
+// stopDNATForward removes the forward from the nftables backend. It returns false if the forward is not by it.
+func stopDNATForward(id string) (bool, error) {
+	dnatForwardsMu.Lock()
+	defer dnatForwardsMu.Unlock()
+
+	if _, ok := dnatForwards[id]; !ok {
+		return false, nil
+	}
+	delete(dnatForwards, id)
+	return true, applyForwardRules()
+}
+
+// updateDNATForwards re-renders the DNAT rules if any of them is destined to the VM.
+func updateDNATForwards(name string) {
+	dnatForwardsMu.Lock()
+	defer dnatForwardsMu.Unlock()
+
+	for _, f := range dnatForwards {
+		if f.ToName == name {
+			err := applyForwardRules()
+			if err != nil {
+				log.Println("Ignore applyForwardRules error:", err)
+			}
+			return
+		}
+	}
+}
+
+// resetForwardRules removes the DNAT rules.
+func resetForwardRules() error {
+	return runNft(fmt.Sprintf("table ip %s\ndelete table ip %s\n", nftForwardTableName, nftForwardTableName))
+}
@@ -0,0 +1,87 @@
+package minivmm
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGenerateForwardRuleset(t *testing.T) {
+	actual := generateForwardRuleset([]*ForwardMetaData{
+		{Proto: "udp", FromPort: "10053", ToName: "vm1", ToPort: "53"},
+		{Proto: "tcp", FromPort: "10022", ToName: "vm1", ToPort: "22"},
+		{Proto: "tcp", FromPort: "10080", ToName: "vm2", ToPort: "80"},
+	}, map[string]string{"vm1": "192.168.200.5"})
+
+	goldenPath := filepath.Join("testdata", "nft", "forward.golden")
+	if *updateGolden {
+		if err := os.WriteFile(goldenPath, []byte(actual), 0644); err != nil {
+			t.Fatalf("failed to update golden file: %v", err)
+		}
+	}
+
+	expected, err := os.ReadFile(goldenPath)
+	if err != nil {
+		t.Fatalf("failed to read golden file: %v", err)
+	}
+	if actual != string(expected) {
+		t.Errorf("ruleset mismatch\nexpected:\n%s\nactual:\n%s", expected, actual)
+	}
+}
+
+func TestGetForwardBackend(t *testing.T) {
+	SetConfig(&Config{ForwardBackend: ForwardBackendNftables})
+
+	for backend, expected := range map[string]string{
+		"":                     ForwardBackendNftables,
+		ForwardBackendProxy:    ForwardBackendProxy,
+		ForwardBackendNftables: ForwardBackendNftables,
+	} {
+		actual, err := getForwardBackend(&ForwardMetaData{Backend: backend})
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if actual != expected {
+			t.Errorf("getForwardBackend(%q) = %s, expected %s", backend, actual, expected)
+		}
+	}
+
+	actual, err := getForwardBackend(&ForwardMetaData{ProxyProtocol: ProxyProtocolV1})
+	if err != nil || actual != ForwardBackendProxy {
+		t.Errorf("PROXY protocol forward is not by the proxy backend: %s, %v", actual, err)
+	}
+
+	_, err = getForwardBackend(&ForwardMetaData{Backend: ForwardBackendNftables, ProxyProtocol: ProxyProtocolV2})
+	if err == nil {
+		t.Errorf("expected error but it does not occur")
+	}
+	_, err = getForwardBackend(&ForwardMetaData{Backend: "iptables"})
+	if err == nil {
+		t.Errorf("expected error but it does not occur")
+	}
+}
+
+func TestValidateForward(t *testing.T) {
+	for _, c := range []struct {
+		f     ForwardMetaData
+		valid bool
+	}{
+		{ForwardMetaData{Proto: "tcp", FromPort: "10022", ToPort: "22"}, true},
+		{ForwardMetaData{Proto: "udp", FromPort: "1", ToPort: "65535"}, true},
+		{ForwardMetaData{Proto: "sctp", FromPort: "10022", ToPort: "22"}, false},
+		{ForwardMetaData{Proto: "tcp dport 1 accept", FromPort: "10022", ToPort: "22"}, false},
+		{ForwardMetaData{Proto: "tcp", FromPort: "0", ToPort: "22"}, false},
+		{ForwardMetaData{Proto: "tcp", FromPort: "10022", ToPort: "65536"}, false},
+		{ForwardMetaData{Proto: "tcp", FromPort: "10022", ToPort: "22 accept"}, false},
+		{ForwardMetaData{Proto: "tcp", FromPort: "+22", ToPort: "22"}, false},
+		{ForwardMetaData{Proto: "tcp", FromPort: "10022", ToPort: ""}, false},
+	} {
+		err := validateForward(&c.f)
+		if c.valid && err != nil {
+			t.Errorf("unexpected error for %+v: %v", c.f, err)
+		}
+		if !c.valid && err == nil {
+			t.Errorf("expected error for %+v but it does not occur", c.f)
+		}
+	}
+}
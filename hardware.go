@@ -0,0 +1,372 @@
+package minivmm
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Hardware is the virtual hardware of VM. It's rendered into QEMU parameters by qemuParamsBuilder.
+// Empty fields mean the defaults. The CPU and memory settings can be changed after create, so the command line
+// of a VM is not fixed.
+type Hardware struct {
+	// Machine is the machine type. If empty, the architecture's default is used.
+	Machine string     `json:"machine"`
+	CPU     CPUSpec    `json:"cpu"`
+	Memory  MemorySpec `json:"memory"`
+	Disk    DiskSpec   `json:"disk"`
+	NIC     NICSpec    `json:"nic"`
+	// Serial is the serial port backend; "" (QEMU default), "none" or "file".
+	Serial string `json:"serial"`
+	// Display is the display backend; "vnc" or "none".
+	Display string `json:"display"`
+	// RNG enables virtio-rng fed by the host's /dev/urandom.
+	RNG bool `json:"rng"`
+	// Balloon enables virtio-balloon to reclaim the guest memory and to collect its statistics.
+	Balloon bool `json:"balloon"`
+}
+
+// CPUSpec is the CPU model and topology of VM. The number of vCPUs is VMMetaData.CPU.
+type CPUSpec struct {
+	// Model is the CPU model. If empty, "host" is used on KVM and the architecture's default on TCG.
+	Model   string `json:"model"`
+	Sockets int    `json:"sockets"`
+	Cores   int    `json:"cores"`
+	Threads int    `json:"threads"`
+	// MaxCPUs is the maximum number of vCPUs which can be hot-plugged. If 0, vCPUs cannot be hot-plugged.
+	MaxCPUs int `json:"max_cpus"`
+	// Pinning is the host CPUs in the cpulist format like "0-3,8". vCPUs are pinned to them in order.
+	Pinning string `json:"pinning"`
+	// NUMANode is the host NUMA node which the guest memory is bound to.
+	NUMANode string `json:"numa_node"`
+}
+
+// MemorySpec is the memory hot-plug settings of VM. The boot memory size is VMMetaData.Memory.
+type MemorySpec struct {
+	// Slots is the number of DIMM slots. If 0, memory cannot be hot-plugged.
+	Slots int `json:"slots"`
+	// MaxMemory is the maximum memory size including hot-plugged DIMMs, like "16G".
+	MaxMemory string `json:"max_memory"`
+}
+
+// DiskSpec is the settings of disks of VM.
+type DiskSpec struct {
+	Bus    string `json:"bus"`
+	Cache  string `json:"cache"`
+	AIO    string `json:"aio"`
+	Format string `json:"format"`
+}
+
+// NICSpec is the settings of NICs of VM.
+type NICSpec struct {
+	Model string `json:"model"`
+}
+
+var (
+	serialLogFileName = "serial.log"
+
+	hardwareChoices = map[string][]string{
+		"disk bus":    {"virtio", "scsi", "ide"},
+		"disk cache":  {"none", "writeback", "writethrough", "directsync", "unsafe"},
+		"disk aio":    {"threads", "native", "io_uring"},
+		"disk format": {"qcow2"}, // the disks are always created as qcow2
+		"nic model":   {"virtio", "e1000", "rtl8139"},
+		"serial":      {"", "none", "file"},
+		"display":     {"vnc", "none"},
+	}
+)
+
+// newHardware returns the hardware spec filled with the defaults.
+func newHardware() *Hardware {
+	hw := &Hardware{Balloon: true}
+	hw.setDefaults()
+	return hw
+}
+
+// newLegacyHardware returns the hardware spec of VMs created before the hardware spec. They have no balloon.
+func newLegacyHardware() *Hardware {
+	hw := &Hardware{}
+	hw.setDefaults()
+	return hw
+}
+
+func (hw *Hardware) setDefaults() {
+	if hw.Disk.Bus == "" {
+		hw.Disk.Bus = "virtio"
+	}
+	if hw.Disk.Cache == "" {
+		hw.Disk.Cache = "none"
+	}
+	if hw.Disk.AIO == "" {
+		hw.Disk.AIO = "threads"
+	}
+	if hw.Disk.Format == "" {
+		hw.Disk.Format = "qcow2"
+	}
+	if hw.NIC.Model == "" {
+		hw.NIC.Model = "virtio"
+	}
+	if hw.Display == "" {
+		hw.Display = "vnc"
+	}
+}
+
+func validateChoice(kind, value string) error {
+	for _, c := range hardwareChoices[kind] {
+		if value == c {
+			return nil
+		}
+	}
+	return errors.Errorf("invalid %s '%s'", kind, value)
+}
+
+// isQ35Machine reports whether the machine type is q35. The empty one is regarded as q35 because it's replaced with
+// q35 on secure boot.
+func isQ35Machine(machine string) bool {
+	typ := strings.SplitN(machine, ",", 2)[0]
+	return typ == "" || typ == "q35" || strings.HasPrefix(typ, "pc-q35-")
+}
+
+// validate checks the hardware spec filled with the defaults.
+func (hw *Hardware) validate(secureBoot bool) error {
+	for kind, value := range map[string]string{
+		"disk bus":    hw.Disk.Bus,
+		"disk cache":  hw.Disk.Cache,
+		"disk aio":    hw.Disk.AIO,
+		"disk format": hw.Disk.Format,
+		"nic model":   hw.NIC.Model,
+		"serial":      hw.Serial,
+		"display":     hw.Display,
+	} {
+		if err := validateChoice(kind, value); err != nil {
+			return err
+		}
+	}
+	if hw.CPU.Sockets < 0 || hw.CPU.Cores < 0 || hw.CPU.Threads < 0 || hw.CPU.MaxCPUs < 0 {
+		return errors.New("invalid CPU topology")
+	}
+	if hw.Memory.Slots < 0 || (hw.Memory.Slots > 0) != (hw.Memory.MaxMemory != "") {
+		return errors.New("memory slots and max memory must be given together")
+	}
+	if secureBoot && !isQ35Machine(hw.Machine) {
+		return errors.Errorf("secure boot requires q35 machine, but '%s' is given", hw.Machine)
+	}
+	return nil
+}
+
+// qemuConfig is the inputs of the QEMU command line other than the hardware spec.
+type qemuConfig struct {
+	Arch              string
+	KVM               bool
+	SecureBoot        bool
+	CPU               string
+	Memory            string
+	Disks             []qemuDisk
+	CloudInitISO      string
+	NICs              []qemuNIC
+	QMPSocketPaths    []string
+	VNCSocketPath     string
+	VNCKeyboardLayout string
+	SerialLogPath     string
+	PIDFilePath       string
+	FirmwareParams    []string
+	TPMSocketPath     string
+}
+
+// qemuNIC is a NIC attached to VM. Script attaches the tap to the bridge of the network.
+type qemuNIC struct {
+	MacAddress string
+	IFName     string
+	Script     string
+}
+
+// qemuDisk is a disk attached to VM. ID identifies the drive and the device for hot-unplugging.
+type qemuDisk struct {
+	ID   string
+	Path string
+	QoS  DiskQoS
+}
+
+func getDiskDriveID(id string) string {
+	return "drive-" + id
+}
+
+func getDiskDeviceID(id string) string {
+	return "disk-" + id
+}
+
+// qemuParamsBuilder accumulates QEMU parameters device by device.
+type qemuParamsBuilder struct {
+	params []string
+}
+
+func (b *qemuParamsBuilder) add(params ...string) *qemuParamsBuilder {
+	b.params = append(b.params, params...)
+	return b
+}
+
+func (b *qemuParamsBuilder) accel(kvm bool, model, tcgModel string) {
+	if kvm {
+		if model == "" {
+			model = "host"
+		}
+		b.add("--enable-kvm", "-cpu", model)
+		return
+	}
+	// fall back to TCG, e.g. the guest architecture differs from the host one
+	if model == "" {
+		model = tcgModel
+	}
+	b.add("-accel", "tcg", "-cpu", model)
+}
+
+func (b *qemuParamsBuilder) disks(disks []qemuDisk, d DiskSpec) {
+	if d.Bus == "scsi" {
+		b.add("-device", "virtio-scsi-pci,id=scsi0")
+	}
+	for i, disk := range disks {
+		if d.Bus == "ide" {
+			b.add("-drive", fmt.Sprintf("file=%s,if=ide,cache=%s,aio=%s,format=%s%s", disk.Path, d.Cache, d.AIO, d.Format, disk.QoS.driveOptions()))
+			continue
+		}
+
+		driveID := getDiskDriveID(disk.ID)
+		b.add("-drive", fmt.Sprintf("file=%s,if=none,id=%s,cache=%s,aio=%s,format=%s%s", disk.Path, driveID, d.Cache, d.AIO, d.Format, disk.QoS.driveOptions()))
+		device := fmt.Sprintf("virtio-blk-pci,drive=%s,id=%s", driveID, getDiskDeviceID(disk.ID))
+		if d.Bus == "scsi" {
+			device = fmt.Sprintf("scsi-hd,drive=%s,id=%s,bus=scsi0.0", driveID, getDiskDeviceID(disk.ID))
+		}
+		if i == 0 {
+			device += ",bootindex=1"
+		}
+		b.add("-device", device)
+	}
+}
+
+func (b *qemuParamsBuilder) machine(machine string, secureBoot bool) {
+	if secureBoot {
+		// secure boot requires SMM to protect the variable store from the guest OS
+		if machine == "" {
+			machine = "q35"
+		}
+		machine += ",smm=on"
+	}
+	if machine != "" {
+		b.add("-machine", machine)
+	}
+}
+
+func (b *qemuParamsBuilder) tpm(socketPath, device string) {
+	if socketPath == "" {
+		return
+	}
+	b.add("-chardev", fmt.Sprintf("socket,id=chrtpm,path=%s", socketPath))
+	b.add("-tpmdev", "emulator,id=tpm0,chardev=chrtpm")
+	b.add("-device", fmt.Sprintf("%s,tpmdev=tpm0", device))
+}
+
+func (b *qemuParamsBuilder) nic(model string, nics []qemuNIC) {
+	for i, n := range nics {
+		if i == 0 {
+			b.add("-net", fmt.Sprintf("nic,model=%s,macaddr=%s", model, n.MacAddress))
+			b.add("-net", fmt.Sprintf("tap,ifname=%s,script=%s,downscript=%s", n.IFName, n.Script, vmIFCleanupScriptPath))
+			continue
+		}
+		// -net connects all NICs to the same hub, so the extra NICs have their own netdevs
+		b.add("-nic", fmt.Sprintf("tap,ifname=%s,script=%s,downscript=%s,model=%s,mac=%s",
+			n.IFName, n.Script, vmIFCleanupScriptPath, model, n.MacAddress))
+	}
+}
+
+func (b *qemuParamsBuilder) smp(cpu string, t CPUSpec) {
+	smp := []string{fmt.Sprintf("cpus=%s", cpu)}
+	if t.MaxCPUs > 0 {
+		smp = append(smp, fmt.Sprintf("maxcpus=%d", t.MaxCPUs))
+	}
+	if t.Sockets > 0 {
+		smp = append(smp, fmt.Sprintf("sockets=%d", t.Sockets))
+	}
+	if t.Cores > 0 {
+		smp = append(smp, fmt.Sprintf("cores=%d", t.Cores))
+	}
+	if t.Threads > 0 {
+		smp = append(smp, fmt.Sprintf("threads=%d", t.Threads))
+	}
+	b.add("-smp", strings.Join(smp, ","))
+}
+
+func (b *qemuParamsBuilder) memory(memory, numaNode string, m MemorySpec) {
+	if m.Slots > 0 {
+		maxMemory, err := ConvertSIPrefixedValue(m.MaxMemory, "mebi")
+		if err != nil {
+			maxMemory = memory
+		}
+		b.add("-m", fmt.Sprintf("%s,slots=%d,maxmem=%sM", memory, m.Slots, maxMemory))
+	} else {
+		b.add("-m", memory)
+	}
+	if numaNode == "" {
+		return
+	}
+	b.add("-object", fmt.Sprintf("memory-backend-ram,id=mem0,size=%sM,host-nodes=%s,policy=bind", memory, numaNode))
+	b.add("-numa", "node,nodeid=0,memdev=mem0")
+}
+
+func (b *qemuParamsBuilder) display(display, vncSocketPath, keyboardLayout string) {
+	if display == "none" {
+		b.add("-display", "none")
+		return
+	}
+	b.add("-vnc", fmt.Sprintf("unix:%s", vncSocketPath))
+	b.add("-k", keyboardLayout)
+}
+
+func (b *qemuParamsBuilder) serial(serial, logPath string) {
+	switch serial {
+	case "none":
+		b.add("-serial", "none")
+	case "file":
+		b.add("-serial", fmt.Sprintf("file:%s", logPath))
+	}
+}
+
+// generateQemuParams renders the hardware spec into QEMU parameters.
+func generateQemuParams(hw *Hardware, c *qemuConfig) []string {
+	spec, err := getArchSpec(c.Arch)
+	if err != nil {
+		spec = archSpecs["x86_64"]
+	}
+
+	b := &qemuParamsBuilder{params: make([]string, 0, 64)}
+	b.accel(c.KVM, hw.CPU.Model, spec.CPUModel)
+	b.disks(c.Disks, hw.Disk)
+	machine := hw.Machine
+	if machine == "" {
+		machine = spec.Machine
+	}
+	b.machine(machine, c.SecureBoot)
+	b.add(c.FirmwareParams...)
+	b.tpm(c.TPMSocketPath, spec.TPMDevice)
+	b.add("-cdrom", c.CloudInitISO)
+	b.nic(hw.NIC.Model, c.NICs)
+	if hw.RNG {
+		b.add("-object", "rng-random,id=rng0,filename=/dev/urandom")
+		b.add("-device", "virtio-rng-pci,rng=rng0")
+	}
+	if hw.Balloon {
+		b.add("-device", "virtio-balloon-pci,id=balloon0,deflate-on-oom=on")
+	}
+	b.add("-daemonize")
+	for _, p := range c.QMPSocketPaths {
+		b.add("-qmp", fmt.Sprintf("unix:%s,server,nowait", p))
+	}
+	b.memory(c.Memory, hw.CPU.NUMANode, hw.Memory)
+	b.smp(c.CPU, hw.CPU)
+	b.display(hw.Display, c.VNCSocketPath, c.VNCKeyboardLayout)
+	b.serial(hw.Serial, c.SerialLogPath)
+	if c.PIDFilePath != "" {
+		b.add("-pidfile", c.PIDFilePath)
+	}
+	return b.params
+}
@@ -0,0 +1,170 @@
+package minivmm
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "update golden files")
+
+func newTestQemuConfig() *qemuConfig {
+	return &qemuConfig{
+		Arch:   "x86_64",
+		KVM:    true,
+		CPU:    "2",
+		Memory: "2048",
+		Disks: []qemuDisk{
+			{ID: "root", Path: "/vms/test/test.qcow2"},
+			{ID: "extra-volume1", Path: "/vms/test/extra-volume1.qcow2"},
+		},
+		CloudInitISO: "/vms/test/cloud-init.iso",
+		NICs: []qemuNIC{
+			{MacAddress: "52:54:00:12:34:56", IFName: "tap-test", Script: "/tmp/ifup-br-minivmm"},
+		},
+		QMPSocketPaths:    []string{"/vms/test/qmp.socket", "/vms/test/qmp-monitor.socket"},
+		VNCSocketPath:     "/vms/test/vnc.socket",
+		VNCKeyboardLayout: "en-us",
+		SerialLogPath:     "/vms/test/serial.log",
+		PIDFilePath:       "/vms/test/qemu.pid",
+	}
+}
+
+func TestGenerateQemuParams(t *testing.T) {
+	testGenerateQemuParams(t, "default", newHardware(), newTestQemuConfig())
+
+	c := newTestQemuConfig()
+	c.Arch = "aarch64"
+	c.KVM = false
+	c.FirmwareParams = []string{"-bios", "/usr/share/qemu-efi-aarch64/QEMU_EFI.fd"}
+	testGenerateQemuParams(t, "aarch64_tcg", newHardware(), c)
+
+	hw := &Hardware{
+		Machine: "q35",
+		CPU:     CPUSpec{Model: "Skylake-Server", Sockets: 1, Cores: 4, Threads: 1, MaxCPUs: 4, Pinning: "2-3", NUMANode: "0"},
+		Memory:  MemorySpec{Slots: 2, MaxMemory: "8G"},
+		Disk:    DiskSpec{Bus: "scsi", Cache: "writeback", AIO: "native"},
+		NIC:     NICSpec{Model: "e1000"},
+		Serial:  "file",
+		Display: "none",
+		RNG:     true,
+		Balloon: true,
+	}
+	hw.setDefaults()
+	c = newTestQemuConfig()
+	c.Disks[0].QoS = DiskQoS{IOPS: 1000, BPSRead: 104857600, BPSWrite: 52428800}
+	c.NICs = append(c.NICs, qemuNIC{MacAddress: "52:54:00:12:34:57", IFName: "tap-test-1", Script: "/tmp/ifup-br-net1"})
+	testGenerateQemuParams(t, "custom", hw, c)
+
+	c = newTestQemuConfig()
+	c.SecureBoot = true
+	c.FirmwareParams = []string{
+		"-global", "driver=cfi.pflash01,property=secure,value=on",
+		"-drive", "if=pflash,format=raw,unit=0,readonly=on,file=/usr/share/OVMF/OVMF_CODE.secboot.fd",
+		"-drive", "if=pflash,format=raw,unit=1,file=/vms/test/efivars.fd",
+	}
+	c.TPMSocketPath = "/vms/test/swtpm.sock"
+	testGenerateQemuParams(t, "secureboot_tpm", newHardware(), c)
+
+	hw = newHardware()
+	hw.Machine = "pc-q35-8.2"
+	c.TPMSocketPath = ""
+	testGenerateQemuParams(t, "secureboot_machine", hw, c)
+}
+
+func TestValidateHardware(t *testing.T) {
+	hw := newHardware()
+	if err := hw.validate(false); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	hw.Disk.Bus = "floppy"
+	if err := hw.validate(false); err == nil {
+		t.Errorf("expected error but it does not occur")
+	}
+
+	hw = newHardware()
+	hw.CPU.Cores = -1
+	if err := hw.validate(false); err == nil {
+		t.Errorf("expected error but it does not occur")
+	}
+
+	hw = newHardware()
+	hw.Machine = "pc-q35-8.2"
+	if err := hw.validate(true); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	hw.Machine = "pc"
+	if err := hw.validate(true); err == nil {
+		t.Errorf("expected error but it does not occur")
+	}
+}
+
+func TestParseCPUList(t *testing.T) {
+	cpus, err := parseCPUList("0-2,5")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if fmt.Sprint(cpus) != "[0 1 2 5]" {
+		t.Errorf("unexpected cpus; expected:[0 1 2 5] actual:%v", cpus)
+	}
+
+	for _, list := range []string{"a", "3-1", "-1", "0-4294967295"} {
+		if _, err := parseCPUList(list); err == nil {
+			t.Errorf("expected error for '%s' but it does not occur", list)
+		}
+	}
+
+	if err := validateCPUTopology("4", CPUSpec{Sockets: 1, Cores: 2, Threads: 2}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := validateCPUTopology("4", CPUSpec{Sockets: 2, Cores: 2, Threads: 2}); err == nil {
+		t.Errorf("expected error but it does not occur")
+	}
+}
+
+func TestGetHardwareLegacy(t *testing.T) {
+	if getHardware(&VMMetaData{}).Balloon {
+		t.Errorf("VMs created before the hardware spec must not have a balloon")
+	}
+}
+
+func TestValidateCPUPlacement(t *testing.T) {
+	orig := onlineCPUsPath
+	defer func() { onlineCPUsPath = orig }()
+	onlineCPUsPath = filepath.Join(t.TempDir(), "online")
+	if err := os.WriteFile(onlineCPUsPath, []byte("0-1,4\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := validateCPUPlacement(CPUSpec{Pinning: "0,4"}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	for _, pinning := range []string{"2", "0-4"} {
+		if err := validateCPUPlacement(CPUSpec{Pinning: pinning}); err == nil {
+			t.Errorf("expected error for '%s' but it does not occur", pinning)
+		}
+	}
+}
+
+func testGenerateQemuParams(t *testing.T, name string, hw *Hardware, c *qemuConfig) {
+	actual := strings.Join(generateQemuParams(hw, c), "\n") + "\n"
+
+	goldenPath := filepath.Join("testdata", "qemu_params", name+".golden")
+	if *updateGolden {
+		if err := os.WriteFile(goldenPath, []byte(actual), 0644); err != nil {
+			t.Fatalf("failed to update golden file: %v", err)
+		}
+	}
+
+	expected, err := os.ReadFile(goldenPath)
+	if err != nil {
+		t.Fatalf("failed to read golden file: %v", err)
+	}
+	if actual != string(expected) {
+		t.Errorf("unexpected params for %s; expected:\n%s\nactual:\n%s", name, expected, actual)
+	}
+}
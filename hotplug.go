@@ -0,0 +1,339 @@
+package minivmm
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/yaamai/govmm/qemu"
+)
+
+// ErrHotplugUnsupported is returned when the change cannot be applied to the running VM by its configuration.
+var ErrHotplugUnsupported = errors.New("hot-plug is not permitted by the VM configuration")
+
+var hotUnplugTimeout = 30 * time.Second
+
+// validateMemoryHotplug checks the boot memory size fits in the maximum memory size.
+func validateMemoryHotplug(memory string, m MemorySpec) error {
+	if m.Slots == 0 {
+		return nil
+	}
+	mem, err := convertMebi(memory)
+	if err != nil {
+		return err
+	}
+	maxMem, err := convertMebi(m.MaxMemory)
+	if err != nil {
+		return err
+	}
+	if mem > maxMem {
+		return errors.Errorf("memory %s exceeds max memory %s", memory, m.MaxMemory)
+	}
+	return nil
+}
+
+func convertMebi(value string) (int, error) {
+	s, err := ConvertSIPrefixedValue(value, "mebi")
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(s)
+}
+
+// withQMP calls f with a QMP connection to the running VM.
+func withQMP(name string, f func(q *qemu.QMP) error) error {
+	q, disconnectedCh, err := initQMP(getQMPSocketPath(name))
+	if err != nil {
+		return errors.Wrap(err, "QMP connection cannot established")
+	}
+	defer func() {
+		q.Shutdown()
+		<-disconnectedCh
+	}()
+	return f(q)
+}
+
+func getHardware(metaData *VMMetaData) *Hardware {
+	if metaData.Hardware == nil {
+		return newLegacyHardware()
+	}
+	return metaData.Hardware
+}
+
+// isDiskHotpluggable reports whether disks on the bus can be hot-plugged.
+func isDiskHotpluggable(hw *Hardware) bool {
+	return hw.Disk.Bus == "virtio" || hw.Disk.Bus == "scsi"
+}
+
+// hotplugVolume attaches the volume to the running VM.
+func hotplugVolume(q *qemu.QMP, hw *Hardware, vol ExtraVolume) error {
+	driveID := getDiskDriveID(vol.Name)
+	direct := hw.Disk.Cache == "none" || hw.Disk.Cache == "directsync"
+	err := executeQMPCommand(q, "blockdev-add", map[string]interface{}{
+		"driver":    hw.Disk.Format,
+		"node-name": driveID,
+		"cache":     map[string]interface{}{"direct": direct},
+		"file": map[string]interface{}{
+			"driver":   "file",
+			"filename": vol.Path,
+			"aio":      hw.Disk.AIO,
+		},
+	}, nil)
+	if err != nil {
+		return errors.Wrap(err, "blockdev-add failed")
+	}
+
+	device := map[string]interface{}{"driver": "virtio-blk-pci", "drive": driveID, "id": getDiskDeviceID(vol.Name)}
+	if hw.Disk.Bus == "scsi" {
+		device["driver"] = "scsi-hd"
+		device["bus"] = "scsi0.0"
+	}
+	err = executeQMPCommand(q, "device_add", device, nil)
+	if err != nil {
+		delErr := executeQMPCommand(q, "blockdev-del", map[string]interface{}{"node-name": driveID}, nil)
+		if delErr != nil {
+			log.Println("Ignore blockdev-del error:", delErr)
+		}
+		return errors.Wrap(err, "device_add failed")
+	}
+	return nil
+}
+
+func isDeviceAttached(q *qemu.QMP, id string) (bool, error) {
+	var props []struct {
+		Name string `json:"name"`
+	}
+	err := executeQMPCommand(q, "qom-list", map[string]interface{}{"path": "/machine/peripheral"}, &props)
+	if err != nil {
+		return false, err
+	}
+	for _, p := range props {
+		if p.Name == id {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// hotUnplugVolume detaches the volume from the running VM. It waits for the guest to release the device.
+func hotUnplugVolume(q *qemu.QMP, volName string) error {
+	deviceID := getDiskDeviceID(volName)
+	err := executeQMPCommand(q, "device_del", map[string]interface{}{"id": deviceID}, nil)
+	if err != nil {
+		return errors.Wrap(err, "device_del failed")
+	}
+
+	for start := time.Now(); ; time.Sleep(500 * time.Millisecond) {
+		attached, err := isDeviceAttached(q, deviceID)
+		if err != nil {
+			return err
+		}
+		if !attached {
+			break
+		}
+		if time.Since(start) > hotUnplugTimeout {
+			return errors.Errorf("the guest does not release '%s'", volName)
+		}
+	}
+
+	// the drives given by the command line are deleted with the device, but hot-plugged ones are not
+	err = executeQMPCommand(q, "blockdev-del", map[string]interface{}{"node-name": getDiskDriveID(volName)}, nil)
+	if err != nil {
+		log.Println("Ignore blockdev-del error:", err)
+	}
+	return nil
+}
+
+// hotplugVCPUs adds vCPUs to the running VM until the number of vCPUs reaches cpu.
+func hotplugVCPUs(q *qemu.QMP, current, cpu int) error {
+	var slots []struct {
+		Type    string                 `json:"type"`
+		Props   map[string]interface{} `json:"props"`
+		QOMPath string                 `json:"qom-path"`
+	}
+	err := executeQMPCommand(q, "query-hotpluggable-cpus", nil, &slots)
+	if err != nil {
+		return errors.Wrap(err, "query-hotpluggable-cpus failed")
+	}
+
+	// QEMU lists the slots in descending order
+	for i := len(slots) - 1; i >= 0 && current < cpu; i-- {
+		if slots[i].QOMPath != "" {
+			continue
+		}
+		args := map[string]interface{}{"driver": slots[i].Type, "id": fmt.Sprintf("vcpu%d", current)}
+		for k, v := range slots[i].Props {
+			args[k] = v
+		}
+		err = executeQMPCommand(q, "device_add", args, nil)
+		if err != nil {
+			return errors.Wrap(err, "device_add failed")
+		}
+		current++
+	}
+	if current < cpu {
+		return errors.Errorf("no free vCPU slot for %d vCPUs", cpu)
+	}
+	return nil
+}
+
+// hotplugMemory adds a DIMM of the size in MiB to the running VM.
+func hotplugMemory(q *qemu.QMP, hw *Hardware, size int) error {
+	var devices []interface{}
+	err := executeQMPCommand(q, "query-memory-devices", nil, &devices)
+	if err != nil {
+		return errors.Wrap(err, "query-memory-devices failed")
+	}
+	if len(devices) >= hw.Memory.Slots {
+		return errors.New("no free memory slot")
+	}
+
+	id := fmt.Sprintf("dimm%d", len(devices))
+	backend := map[string]interface{}{"qom-type": "memory-backend-ram", "id": "mem-" + id, "size": int64(size) * 1024 * 1024}
+	if hw.CPU.NUMANode != "" {
+		node, _ := strconv.Atoi(hw.CPU.NUMANode)
+		backend["host-nodes"] = []int{node}
+		backend["policy"] = "bind"
+	}
+	err = executeQMPCommand(q, "object-add", backend, nil)
+	if err != nil {
+		return errors.Wrap(err, "object-add failed")
+	}
+	err = executeQMPCommand(q, "device_add", map[string]interface{}{"driver": "pc-dimm", "id": id, "memdev": "mem-" + id}, nil)
+	if err != nil {
+		delErr := executeQMPCommand(q, "object-del", map[string]interface{}{"id": "mem-" + id}, nil)
+		if delErr != nil {
+			log.Println("Ignore object-del error:", delErr)
+		}
+		return errors.Wrap(err, "device_add failed")
+	}
+	return nil
+}
+
+// HotplugResizeVM applies the new size to the running VM without restarting it. vCPUs and memory can only be
+// increased within the maximum given by the hardware spec, and the root disk can only be grown.
+// If the VM is not running or the change is not permitted, ErrHotplugUnsupported is returned without any change.
+func HotplugResizeVM(name, cpu, memory, disk string) (*VMMetaData, error) {
+	metaData, err := GetVM(name)
+	if err != nil {
+		return nil, errors.Wrap(err, "HotplugResizeVM: Failed to get VM metadata")
+	}
+	if metaData.Status != "running" {
+		return nil, ErrHotplugUnsupported
+	}
+	hw := getHardware(metaData)
+
+	// check the whole change is permitted before applying any of them
+	curCPU, newCPU := 0, 0
+	if cpu != "" {
+		curCPU, err = strconv.Atoi(metaData.CPU)
+		if err != nil {
+			return nil, err
+		}
+		newCPU, err = strconv.Atoi(cpu)
+		if err != nil {
+			return nil, errors.Errorf("invalid cpu '%s'", cpu)
+		}
+		if newCPU < curCPU || (newCPU > curCPU && newCPU > hw.CPU.MaxCPUs) {
+			return nil, ErrHotplugUnsupported
+		}
+	}
+	curMem, newMem := 0, 0
+	if memory != "" {
+		curMem, err = convertMebi(metaData.Memory)
+		if err != nil {
+			return nil, err
+		}
+		newMem, err = convertMebi(memory)
+		if err != nil {
+			return nil, err
+		}
+		if newMem < curMem || (newMem > curMem && (hw.Memory.Slots == 0 || validateMemoryHotplug(memory, hw.Memory) != nil)) {
+			return nil, ErrHotplugUnsupported
+		}
+	}
+	var newDisk int64
+	if disk != "" {
+		d, err := ConvertSIPrefixedValue(disk, "")
+		if err != nil {
+			return nil, err
+		}
+		newDisk, err = strconv.ParseInt(d, 10, 64)
+		if err != nil {
+			return nil, errors.Errorf("invalid disk '%s'", disk)
+		}
+		curDisk, err := getVMDiskBytes(metaData)
+		if err != nil {
+			return nil, errors.Wrap(err, "HotplugResizeVM: Failed to get disk size")
+		}
+		// block_resize shrinks the live image, so it must never be given a smaller size
+		if newDisk < curDisk {
+			return nil, errors.Errorf("disk cannot be shrunk from %d to %d bytes", curDisk, newDisk)
+		}
+		if newDisk > curDisk && !isDiskHotpluggable(hw) {
+			return nil, ErrHotplugUnsupported
+		}
+	}
+
+	release, err := reserveResizeQuota(metaData, cpu, memory, disk)
+	if err != nil {
+		return nil, errors.Wrap(err, "HotplugResizeVM")
+	}
+	defer release()
+	// the running VM gets the resources immediately, not on the next start
+	req, err := newResizeRequest(metaData, cpu, memory, disk)
+	if err != nil {
+		return nil, errors.Wrap(err, "HotplugResizeVM")
+	}
+	releaseAdmission, err := reserveAdmission(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "HotplugResizeVM")
+	}
+	defer releaseAdmission()
+
+	// the applied changes are saved even if the following one fails, because they cannot be reverted
+	err = withQMP(name, func(q *qemu.QMP) error {
+		if disk != "" {
+			err := executeQMPCommand(q, "block_resize", map[string]interface{}{"device": getDiskDriveID("root"), "size": newDisk}, nil)
+			if err != nil {
+				return errors.Wrap(err, "block_resize failed")
+			}
+			metaData.Disk = disk
+		}
+		if newCPU > curCPU {
+			metaData.DevicesChanged = true
+			err := hotplugVCPUs(q, curCPU, newCPU)
+			if err != nil {
+				return err
+			}
+			metaData.CPU = cpu
+		}
+		if newMem > curMem {
+			metaData.DevicesChanged = true
+			err := hotplugMemory(q, hw, newMem-curMem)
+			if err != nil {
+				return err
+			}
+			metaData.Memory = memory
+		}
+		return nil
+	})
+	saveErr := saveVMMetaData(name, metaData)
+	if err != nil {
+		return nil, errors.Wrap(err, "HotplugResizeVM")
+	}
+	if saveErr != nil {
+		return nil, saveErr
+	}
+
+	if newCPU > curCPU {
+		// the hot-plugged vCPU threads are not pinned yet
+		err = pinVCPUs(name, hw.CPU)
+		if err != nil {
+			log.Println("Ignore pinVCPUs error:", err)
+		}
+	}
+	return metaData, nil
+}
@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"strings"
 
 	"github.com/pkg/errors"
 )
@@ -17,12 +19,25 @@ func ListBaseImages() []string {
 
 	names := []string{}
 	for _, f := range files {
+		// hidden files are images in progress and metadata of images
+		if strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
 		names = append(names, f.Name())
 	}
 
 	return names
 }
 
+// validateImageName checks the image name can be a file name in the image directory.
+// The names starting with "." are reserved for images in progress and metadata of images.
+func validateImageName(name string) error {
+	if name == "" || strings.Contains(name, "/") || strings.HasPrefix(name, ".") {
+		return errors.Errorf("invalid image name '%s'", name)
+	}
+	return nil
+}
+
 // CreateImage creates a new image with backing file. If created image virtual size is lesser than disk size, this will return error, but created image file won't be removed.
 func CreateImage(name, size, base, dstDir string) (string, error) {
 	err := os.MkdirAll(dstDir, os.ModePerm)
@@ -55,6 +70,31 @@ func CreateImage(name, size, base, dstDir string) (string, error) {
 	return p, nil
 }
 
+// CopyImage copies the image into a new qcow2 image. If base is given, the new image is backed by the base image
+// and only the clusters differing from it are copied.
+func CopyImage(src, name, base, dstDir string) (string, error) {
+	err := os.MkdirAll(dstDir, os.ModePerm)
+	if err != nil {
+		return "", err
+	}
+
+	params := []string{"qemu-img", "convert", "-O", "qcow2", "-o", "cluster_size=2M"}
+	if base != "" {
+		b, _ := filepath.Abs(filepath.Join(C.ImageDir, base))
+		params = append(params, "-o", "backing_fmt=qcow2", "-B", b)
+	}
+	p, _ := filepath.Abs(filepath.Join(dstDir, name+".qcow2"))
+	params = append(params, src, p)
+
+	log.Println("Copying image: ", params)
+	err = Execs([][]string{params})
+	if err != nil {
+		return "", err
+	}
+
+	return p, nil
+}
+
 // ResizeImage resizes the image size.
 func ResizeImage(name, size, dstDir string) error {
 	p, _ := filepath.Abs(filepath.Join(dstDir, name+".qcow2"))
@@ -85,3 +125,84 @@ func checkImageSize(path string) error {
 
 	return nil
 }
+
+// CreateImageSnapshot creates an internal snapshot in the qcow2 image.
+func CreateImageSnapshot(path, tag string) error {
+	return Execs([][]string{{"qemu-img", "snapshot", "-c", tag, path}})
+}
+
+// RevertImageSnapshot reverts the qcow2 image to the internal snapshot.
+func RevertImageSnapshot(path, tag string) error {
+	return Execs([][]string{{"qemu-img", "snapshot", "-a", tag, path}})
+}
+
+// DeleteImageSnapshot deletes the internal snapshot from the qcow2 image.
+func DeleteImageSnapshot(path, tag string) error {
+	return Execs([][]string{{"qemu-img", "snapshot", "-d", tag, path}})
+}
+
+// CreateBaseImageFromVM flattens the stopped VM's root disk into a new base image.
+// The image is written as a hidden file and renamed when it's completed, so that it's not listed during creation.
+func CreateBaseImageFromVM(vmName, imageName string, imageMetaData *ImageMetaData, sparsify, compress bool) (string, error) {
+	err := validateImageName(imageName)
+	if err != nil {
+		return "", err
+	}
+	dst := filepath.Join(C.ImageDir, imageName)
+	if exists(dst) {
+		return "", errors.Errorf("image '%s' already exists", imageName)
+	}
+
+	metaData, err := GetVM(vmName)
+	if err != nil {
+		return "", errors.Wrap(err, "CreateBaseImageFromVM: Failed to get VM metadata")
+	}
+	if metaData.Status != "stopped" && metaData.Status != "suspended" {
+		return "", errors.New("Cannot create image from non-stopped VM")
+	}
+
+	tmp := filepath.Join(C.ImageDir, "."+imageName+".tmp")
+	defer os.Remove(tmp)
+
+	// converting without backing file flattens the backing chain
+	params := []string{"qemu-img", "convert", "-O", "qcow2"}
+	if compress {
+		params = append(params, "-c")
+	}
+	params = append(params, metaData.Volume, tmp)
+	log.Println("Creating base image: ", params)
+	err = Execs([][]string{params})
+	if err != nil {
+		return "", err
+	}
+
+	if sparsify {
+		if _, err := exec.LookPath("virt-sparsify"); err == nil {
+			err = Execs([][]string{{"virt-sparsify", "--in-place", tmp}})
+			if err != nil {
+				return "", err
+			}
+		} else {
+			// qemu-img convert already skips the zeroed blocks, but cannot discard the unused blocks in filesystems
+			log.Println("[image] WARN virt-sparsify is not installed, so the image is sparsified by qemu-img only")
+		}
+	}
+
+	err = os.Rename(tmp, dst)
+	if err != nil {
+		return "", err
+	}
+
+	if imageMetaData.Arch == "" {
+		imageMetaData.Arch = getMachineArchFromMetaData(metaData)
+	}
+	if imageMetaData.MinDisk == "" {
+		imageMetaData.MinDisk = metaData.Disk
+	}
+	err = createImageMetaData(imageName, imageMetaData)
+	if err != nil {
+		return "", err
+	}
+
+	return imageName, nil
+}
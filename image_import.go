@@ -0,0 +1,307 @@
+package minivmm
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Status of image importing.
+const (
+	ImageImportReceiving  = "receiving"
+	ImageImportVerifying  = "verifying"
+	ImageImportConverting = "converting"
+	ImageImportCompleted  = "completed"
+	ImageImportFailed     = "failed"
+)
+
+// ImageImport is the progress of an image importing.
+type ImageImport struct {
+	Name          string `json:"name"`
+	Source        string `json:"source"`
+	Status        string `json:"status"`
+	TotalBytes    int64  `json:"total_bytes"`
+	ReceivedBytes int64  `json:"received_bytes"`
+	Error         string `json:"error"`
+}
+
+var imageImports = struct {
+	sync.Mutex
+	m map[string]*ImageImport
+}{m: map[string]*ImageImport{}}
+
+// progressWriter counts the bytes written into the image importing.
+type progressWriter struct {
+	name string
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	imageImports.Lock()
+	defer imageImports.Unlock()
+	if i, ok := imageImports.m[w.name]; ok {
+		i.ReceivedBytes += int64(len(p))
+	}
+	return len(p), nil
+}
+
+func setImageImportStatus(name, status string, err error) {
+	imageImports.Lock()
+	defer imageImports.Unlock()
+	i, ok := imageImports.m[name]
+	if !ok {
+		return
+	}
+	i.Status = status
+	if err != nil {
+		i.Error = err.Error()
+	}
+}
+
+func registerImageImport(name, source string, totalBytes int64) error {
+	imageImports.Lock()
+	defer imageImports.Unlock()
+	if i, ok := imageImports.m[name]; ok && i.Status != ImageImportCompleted && i.Status != ImageImportFailed {
+		return errors.Errorf("image '%s' is being imported", name)
+	}
+	imageImports.m[name] = &ImageImport{
+		Name:       name,
+		Source:     source,
+		Status:     ImageImportReceiving,
+		TotalBytes: totalBytes,
+	}
+	return nil
+}
+
+// ListImageImports returns a list of image importings.
+func ListImageImports() []ImageImport {
+	imageImports.Lock()
+	defer imageImports.Unlock()
+	ret := []ImageImport{}
+	for _, i := range imageImports.m {
+		ret = append(ret, *i)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret
+}
+
+// parseChecksum parses a checksum string like "sha256:<hex>". If the algorithm is omitted, it's guessed by the length.
+func parseChecksum(checksum string) (hash.Hash, string, error) {
+	algo, sum := "", strings.ToLower(checksum)
+	if s := strings.SplitN(checksum, ":", 2); len(s) == 2 {
+		algo, sum = strings.ToLower(s[0]), strings.ToLower(s[1])
+	}
+	if algo == "" {
+		switch len(sum) {
+		case sha256.Size * 2:
+			algo = "sha256"
+		case sha512.Size * 2:
+			algo = "sha512"
+		}
+	}
+
+	if _, err := hex.DecodeString(sum); err != nil {
+		return nil, "", errors.Wrap(err, "invalid checksum")
+	}
+	switch algo {
+	case "sha256":
+		return sha256.New(), sum, nil
+	case "sha512":
+		return sha512.New(), sum, nil
+	}
+	return nil, "", errors.Errorf("unsupported checksum '%s'", checksum)
+}
+
+func verifyChecksum(path, checksum string) error {
+	h, sum, err := parseChecksum(checksum)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+
+	actual := hex.EncodeToString(h.Sum(nil))
+	if actual != sum {
+		return errors.Errorf("checksum mismatch; expected:%s actual:%s", sum, actual)
+	}
+	return nil
+}
+
+func receiveImage(name, path string, r io.Reader) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(io.MultiWriter(f, &progressWriter{name}), r)
+	return err
+}
+
+func downloadImage(name, url, path string) error {
+	resp, err := http.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("failed to download '%s': %s", url, resp.Status)
+	}
+
+	imageImports.Lock()
+	if i, ok := imageImports.m[name]; ok {
+		i.TotalBytes = resp.ContentLength
+	}
+	imageImports.Unlock()
+
+	return receiveImage(name, path, resp.Body)
+}
+
+// validateImportedImage checks the image is self-contained. The files referred by the image, such as a backing
+// file, would let the image read arbitrary files on the host.
+func validateImportedImage(info *imageInfo) error {
+	if info.BackingFilename != "" || info.FullBackingFilename != "" {
+		return errors.New("images with a backing file are not supported")
+	}
+	switch info.Format {
+	case "vmdk":
+		// monolithicFlat is a descriptor referring to a separate extent file
+		switch info.FormatSpecific.Data.CreateType {
+		case "monolithicSparse", "streamOptimized":
+		default:
+			return errors.Errorf("vmdk create type '%s' is not supported", info.FormatSpecific.Data.CreateType)
+		}
+	case "qcow2":
+		if info.FormatSpecific.Data.DataFile != "" {
+			return errors.New("qcow2 images with an external data file are not supported")
+		}
+	}
+	return nil
+}
+
+// finishImageImport verifies the received image, converts it to qcow2 and makes it visible as a base image.
+func finishImageImport(name, path, checksum string, metaData *ImageMetaData) error {
+	defer os.Remove(path)
+
+	setImageImportStatus(name, ImageImportVerifying, nil)
+	err := verifyChecksum(path, checksum)
+	if err != nil {
+		return err
+	}
+
+	info, err := getImageInfo(path)
+	if err != nil {
+		return err
+	}
+	err = validateImportedImage(info)
+	if err != nil {
+		return err
+	}
+	format := info.Format
+	switch format {
+	case "qcow2":
+	case "raw", "vmdk", "vhdx":
+		setImageImportStatus(name, ImageImportConverting, nil)
+		converted := filepath.Join(C.ImageDir, "."+name+".tmp")
+		defer os.Remove(converted)
+		err = Execs([][]string{{"qemu-img", "convert", "-f", format, "-O", "qcow2", path, converted}})
+		if err != nil {
+			return err
+		}
+		path = converted
+	default:
+		return errors.Errorf("unsupported image format '%s'", format)
+	}
+
+	err = os.Rename(path, filepath.Join(C.ImageDir, name))
+	if err != nil {
+		return err
+	}
+	return createImageMetaData(name, metaData)
+}
+
+func runImageImport(name, path, checksum string, metaData *ImageMetaData, receive func() error) {
+	err := receive()
+	if err == nil {
+		err = finishImageImport(name, path, checksum, metaData)
+	}
+	if err != nil {
+		os.Remove(path)
+		log.Printf("[image] WARN failed to import '%s': %v\n", name, err)
+		setImageImportStatus(name, ImageImportFailed, err)
+		return
+	}
+	log.Printf("[image] INFO imported '%s'\n", name)
+	setImageImportStatus(name, ImageImportCompleted, nil)
+}
+
+func prepareImageImport(name, source, checksum string, totalBytes int64) (string, error) {
+	err := validateImageName(name)
+	if err != nil {
+		return "", err
+	}
+	if exists(filepath.Join(C.ImageDir, name)) {
+		return "", errors.Errorf("image '%s' already exists", name)
+	}
+	if _, _, err := parseChecksum(checksum); err != nil {
+		return "", err
+	}
+
+	err = registerImageImport(name, source, totalBytes)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(C.ImageDir, "."+name+".download"), nil
+}
+
+// ImportImageFromURL downloads an image from the http(s) URL in the background.
+func ImportImageFromURL(name, url, checksum string, metaData *ImageMetaData) error {
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return fmt.Errorf("unsupported url '%s'", url)
+	}
+	path, err := prepareImageImport(name, url, checksum, 0)
+	if err != nil {
+		return err
+	}
+
+	go runImageImport(name, path, checksum, metaData, func() error {
+		return downloadImage(name, url, path)
+	})
+	return nil
+}
+
+// ImportImageFromReader receives an image from the reader, and verifies and converts it in the background.
+func ImportImageFromReader(name, checksum string, r io.Reader, size int64, metaData *ImageMetaData) error {
+	path, err := prepareImageImport(name, "upload", checksum, size)
+	if err != nil {
+		return err
+	}
+
+	err = receiveImage(name, path, r)
+	if err != nil {
+		os.Remove(path)
+		setImageImportStatus(name, ImageImportFailed, err)
+		return err
+	}
+
+	go runImageImport(name, path, checksum, metaData, func() error { return nil })
+	return nil
+}
@@ -0,0 +1,108 @@
+package minivmm
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestDownloadImage(t *testing.T) {
+	content := []byte("dummy image content")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/image.img" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(content)
+	}))
+	defer ts.Close()
+
+	name := "test-download"
+	path := filepath.Join(t.TempDir(), "image.img")
+	err := registerImageImport(name, ts.URL+"/image.img", 0)
+	if err != nil {
+		t.Fatalf("register error: %v", err)
+	}
+
+	err = downloadImage(name, ts.URL+"/image.img", path)
+	if err != nil {
+		t.Fatalf("download error: %v", err)
+	}
+	for _, i := range ListImageImports() {
+		if i.Name == name && i.ReceivedBytes != int64(len(content)) {
+			t.Errorf("unexpected received bytes; expected:%d actual:%d", len(content), i.ReceivedBytes)
+		}
+	}
+
+	sum256 := sha256.Sum256(content)
+	sum512 := sha512.Sum512(content)
+	for _, checksum := range []string{
+		"sha256:" + hex.EncodeToString(sum256[:]),
+		"sha512:" + hex.EncodeToString(sum512[:]),
+		hex.EncodeToString(sum256[:]),
+	} {
+		if err := verifyChecksum(path, checksum); err != nil {
+			t.Errorf("verify error: %v", err)
+		}
+	}
+
+	err = verifyChecksum(path, "sha256:"+hex.EncodeToString(make([]byte, sha256.Size)))
+	if err == nil {
+		t.Errorf("expected checksum mismatch but it does not occur")
+	}
+
+	err = downloadImage(name, ts.URL+"/missing.img", path)
+	if err == nil {
+		t.Errorf("expected download error but it does not occur")
+	}
+}
+
+func TestParseChecksum(t *testing.T) {
+	var err error
+	_, _, err = parseChecksum("md5:d41d8cd98f00b204e9800998ecf8427e")
+	if err == nil {
+		t.Errorf("expected error but it does not occur")
+	}
+	_, _, err = parseChecksum("sha256:NOTHEX")
+	if err == nil {
+		t.Errorf("expected error but it does not occur")
+	}
+	_, _, err = parseChecksum("")
+	if err == nil {
+		t.Errorf("expected error but it does not occur")
+	}
+}
+
+func TestValidateImportedImage(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		info  string
+		valid bool
+	}{
+		{"qcow2", `{"format": "qcow2", "format-specific": {"type": "qcow2", "data": {"compat": "1.1"}}}`, true},
+		{"raw", `{"format": "raw"}`, true},
+		{"vmdk monolithic", `{"format": "vmdk", "format-specific": {"type": "vmdk", "data": {"create-type": "monolithicSparse"}}}`, true},
+		{"vmdk stream", `{"format": "vmdk", "format-specific": {"type": "vmdk", "data": {"create-type": "streamOptimized"}}}`, true},
+		{"backing file", `{"format": "qcow2", "backing-filename": "/etc/shadow"}`, false},
+		{"qcow2 data file", `{"format": "qcow2", "format-specific": {"type": "qcow2", "data": {"data-file": "/etc/shadow"}}}`, false},
+		{"vmdk flat", `{"format": "vmdk", "format-specific": {"type": "vmdk", "data": {"create-type": "monolithicFlat"}}}`, false},
+		{"vmdk split", `{"format": "vmdk", "format-specific": {"type": "vmdk", "data": {"create-type": "twoGbMaxExtentSparse"}}}`, false},
+	} {
+		var info imageInfo
+		if err := json.Unmarshal([]byte(c.info), &info); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		err := validateImportedImage(&info)
+		if c.valid && err != nil {
+			t.Errorf("%s: unexpected error: %v", c.name, err)
+		}
+		if !c.valid && err == nil {
+			t.Errorf("%s: expected error but it does not occur", c.name)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package minivmm
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ImageMetaData is base image's metadata. It's stored as a hidden sidecar file next to the image.
+type ImageMetaData struct {
+	Name        string    `json:"name"`
+	OSFamily    string    `json:"os_family"`
+	Arch        string    `json:"arch"`
+	VirtualSize int64     `json:"virtual_size"`
+	Format      string    `json:"format"`
+	DefaultUser string    `json:"default_user"`
+	MinDisk     string    `json:"min_disk"`
+	MinMemory   string    `json:"min_memory"`
+	Description string    `json:"description"`
+	Owner       string    `json:"owner"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type imageInfo struct {
+	Format              string `json:"format"`
+	VirtualSize         int64  `json:"virtual-size"`
+	BackingFilename     string `json:"backing-filename"`
+	FullBackingFilename string `json:"full-backing-filename"`
+	FormatSpecific      struct {
+		Type string `json:"type"`
+		Data struct {
+			// vmdk
+			CreateType string `json:"create-type"`
+			// qcow2
+			DataFile string `json:"data-file"`
+		} `json:"data"`
+	} `json:"format-specific"`
+}
+
+func getImageMetaDataPath(name string) string {
+	return filepath.Join(C.ImageDir, "."+name+".json")
+}
+
+// getImageInfo returns the information of the image. It can inspect images used by running VMs.
+func getImageInfo(path string) (*imageInfo, error) {
+	stdouts, err := ExecsStdout([][]string{{"qemu-img", "info", "-U", "--output", "json", path}})
+	if err != nil {
+		return nil, err
+	}
+
+	var info imageInfo
+	err = json.Unmarshal([]byte(stdouts[0]), &info)
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+func saveImageMetaData(name string, metaData *ImageMetaData) error {
+	b, err := json.Marshal(metaData)
+	if err != nil {
+		return err
+	}
+
+	metaDataPath := getImageMetaDataPath(name)
+	f, err := os.OpenFile(metaDataPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return WriteWithLock(f, metaDataPath+".lock", b)
+}
+
+// createImageMetaData completes the given metadata with the image information and saves it.
+func createImageMetaData(name string, metaData *ImageMetaData) error {
+	if metaData == nil {
+		metaData = &ImageMetaData{}
+	}
+	if metaData.CreatedAt.IsZero() {
+		metaData.CreatedAt = time.Now()
+	}
+	err := fillImageMetaData(name, metaData)
+	if err != nil {
+		return err
+	}
+
+	return saveImageMetaData(name, metaData)
+}
+
+// fillImageMetaData sets the name and the image information to the metadata.
+func fillImageMetaData(name string, metaData *ImageMetaData) error {
+	metaData.Name = name
+	info, err := getImageInfo(filepath.Join(C.ImageDir, name))
+	if err != nil {
+		return err
+	}
+	metaData.Format = info.Format
+	metaData.VirtualSize = info.VirtualSize
+	return nil
+}
+
+// GetImageMetaData returns the base image's metadata. If the image has no metadata, such as the image put
+// into the image directory by hand, its metadata is made from the image information without saving it.
+func GetImageMetaData(name string) (*ImageMetaData, error) {
+	if !exists(filepath.Join(C.ImageDir, name)) {
+		return nil, fmt.Errorf("No such a image '%s'", name)
+	}
+
+	b, err := os.ReadFile(getImageMetaDataPath(name))
+	if err != nil {
+		metaData := &ImageMetaData{}
+		if st, err := os.Stat(filepath.Join(C.ImageDir, name)); err == nil {
+			metaData.CreatedAt = st.ModTime()
+		}
+		err = fillImageMetaData(name, metaData)
+		if err != nil {
+			return nil, err
+		}
+		return metaData, nil
+	}
+
+	var metaData ImageMetaData
+	err = json.Unmarshal(b, &metaData)
+	if err != nil {
+		return nil, err
+	}
+	return &metaData, nil
+}
+
+// ListImageMetaData returns a list of base images' metadata.
+func ListImageMetaData() []*ImageMetaData {
+	ret := []*ImageMetaData{}
+	for _, name := range ListBaseImages() {
+		m, err := GetImageMetaData(name)
+		if err != nil {
+			log.Println("Ignore GetImageMetaData error:", err)
+			m = &ImageMetaData{Name: name}
+		}
+		ret = append(ret, m)
+	}
+	return ret
+}
+
+// getImageUsers returns the names of VMs whose volumes are backed by the image.
+func getImageUsers(name string) ([]string, error) {
+	imagePath, _ := filepath.Abs(filepath.Join(C.ImageDir, name))
+
+	vms, err := ListVMs()
+	if err != nil {
+		return nil, err
+	}
+
+	users := []string{}
+	for _, vm := range vms {
+		for _, p := range getVolumePaths(vm) {
+			info, err := getImageInfo(p)
+			if err != nil {
+				// judge by the metadata if the volume cannot be inspected
+				log.Println("Ignore getImageInfo error:", err)
+				if p == vm.Volume && vm.Image == name {
+					users = append(users, vm.Name)
+					break
+				}
+				continue
+			}
+			if info.FullBackingFilename == imagePath {
+				users = append(users, vm.Name)
+				break
+			}
+		}
+	}
+	return users, nil
+}
+
+// DeleteImage deletes the base image and its metadata. It refuses to delete the image used by any VM.
+func DeleteImage(name string) error {
+	err := validateImageName(name)
+	if err != nil {
+		return err
+	}
+	if !exists(filepath.Join(C.ImageDir, name)) {
+		return fmt.Errorf("Cannot delete '%s'. No such a image", name)
+	}
+
+	users, err := getImageUsers(name)
+	if err != nil {
+		return errors.Wrap(err, "DeleteImage: Failed to check image users")
+	}
+	if len(users) > 0 {
+		return errors.Errorf("Cannot delete '%s'. It's used by VMs %v", name, users)
+	}
+
+	err = os.Remove(filepath.Join(C.ImageDir, name))
+	if err != nil {
+		return err
+	}
+	os.Remove(getImageMetaDataPath(name))
+	os.Remove(getImageMetaDataPath(name) + ".lock")
+	return nil
+}
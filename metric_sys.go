@@ -1,6 +1,9 @@
 package minivmm
 
 import (
+	"log"
+	"sort"
+
 	"github.com/mackerelio/go-osstat/cpu"
 	"github.com/mackerelio/go-osstat/memory"
 	"golang.org/x/sys/unix"
@@ -13,6 +16,16 @@ type SysMetric struct {
 	MemoryBytesUsed uint64 `json:"minivmm_sys_memory_bytes_used"`
 	DiskBytes       uint64 `json:"minivmm_sys_disk_bytes"`
 	DiskBytesUsed   uint64 `json:"minivmm_sys_disk_bytes_used"`
+	// CPUCoresPinned is the number of host CPUs which vCPUs of running VMs are pinned to.
+	CPUCoresPinned int                 `json:"minivmm_sys_cpu_cores_pinned"`
+	NUMANodes      []NUMANodeSysMetric `json:"minivmm_sys_numa_nodes"`
+}
+
+// NUMANodeSysMetric is the metrics of a host NUMA node which VMs' memory is bound to.
+type NUMANodeSysMetric struct {
+	Node             string `json:"node"`
+	MemoryBytes      uint64 `json:"memory_bytes"`
+	MemoryBytesBound uint64 `json:"memory_bytes_bound"`
 }
 
 // GetSysMetric returns the system resource metrics.
@@ -35,6 +48,11 @@ func GetSysMetric() (*SysMetric, error) {
 	m.DiskBytes = getDiskSizeTotal(C.Dir)
 	m.DiskBytesUsed = getDiskSizeUsed(C.Dir)
 
+	err = accountCPUPlacement(&m)
+	if err != nil {
+		return nil, err
+	}
+
 	return &m, nil
 }
 
@@ -51,3 +69,50 @@ func getDiskSizeUsed(path string) uint64 {
 
 	return (stat.Blocks - stat.Bavail) * uint64(stat.Bsize)
 }
+
+// accountCPUPlacement sums up the host CPUs and NUMA node memory dedicated to running VMs.
+func accountCPUPlacement(m *SysMetric) error {
+	vms, err := ListVMs()
+	if err != nil {
+		return err
+	}
+
+	pinned := map[int]bool{}
+	bound := map[string]uint64{}
+	for _, vm := range vms {
+		if vm.Hardware == nil || vm.Status != "running" {
+			continue
+		}
+		cpus, err := parseCPUList(vm.Hardware.CPU.Pinning)
+		if err != nil {
+			log.Printf("failed to parse cpu pinning, %v\n", err)
+		}
+		for _, c := range cpus {
+			pinned[c] = true
+		}
+		if node := vm.Hardware.CPU.NUMANode; node != "" {
+			mem, err := parseMemoryBytes(vm.Memory)
+			if err != nil {
+				log.Printf("failed to parse memory info, %v\n", err)
+				continue
+			}
+			bound[node] += uint64(mem)
+		}
+	}
+	m.CPUCoresPinned = len(pinned)
+
+	nodes := []string{}
+	for node := range bound {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	m.NUMANodes = []NUMANodeSysMetric{}
+	for _, node := range nodes {
+		total, err := getNUMANodeMemory(node)
+		if err != nil {
+			log.Printf("failed to get numa node memory, %v\n", err)
+		}
+		m.NUMANodes = append(m.NUMANodes, NUMANodeSysMetric{Node: node, MemoryBytes: total, MemoryBytesBound: bound[node]})
+	}
+	return nil
+}
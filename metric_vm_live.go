@@ -0,0 +1,198 @@
+package minivmm
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/yaamai/govmm/qemu"
+)
+
+// clock ticks per second of /proc/<pid>/stat, which is 100 on all architectures Linux supports today
+const clockTicks = 100
+
+// VMLiveMetric is the resource usage of a running VM.
+type VMLiveMetric struct {
+	Name       string         `json:"name"`
+	Owner      string         `json:"owner"`
+	Tag        string         `json:"tag"`
+	CPUSeconds float64        `json:"cpu_seconds"`
+	RSSBytes   int64          `json:"rss_bytes"`
+	Disks      []VMDiskMetric `json:"disks"`
+	NetRxBytes int64          `json:"net_rx_bytes"`
+	NetTxBytes int64          `json:"net_tx_bytes"`
+	Memory     *VMMemoryStats `json:"memory"`
+}
+
+// VMDiskMetric is the I/O statistics of a disk of VM.
+type VMDiskMetric struct {
+	Disk       string `json:"disk"`
+	ReadBytes  int64  `json:"read_bytes"`
+	WriteBytes int64  `json:"write_bytes"`
+	ReadOps    int64  `json:"read_ops"`
+	WriteOps   int64  `json:"write_ops"`
+}
+
+func readQemuPID(name string) (int, error) {
+	pid, ok := readAlivePID(getPIDFilePath(name), "qemu-system")
+	if !ok {
+		return 0, errors.Errorf("QEMU process of '%s' is not found", name)
+	}
+	return pid, nil
+}
+
+// getProcessUsage returns the CPU time in seconds and the RSS in bytes of the process.
+func getProcessUsage(pid int) (float64, int64, error) {
+	b, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return 0, 0, err
+	}
+	// the command name in parentheses may contain spaces
+	s := string(b)
+	fields := strings.Fields(s[strings.LastIndex(s, ")")+1:])
+	// fields[0] is the 3rd field "state"; utime, stime and rss are the 14th, 15th and 24th
+	if len(fields) < 22 {
+		return 0, 0, errors.Errorf("unexpected format of /proc/%d/stat", pid)
+	}
+	utime, _ := strconv.ParseInt(fields[11], 10, 64)
+	stime, _ := strconv.ParseInt(fields[12], 10, 64)
+	rss, _ := strconv.ParseInt(fields[21], 10, 64)
+	return float64(utime+stime) / clockTicks, rss * int64(os.Getpagesize()), nil
+}
+
+func queryBlockStats(q *qemu.QMP) ([]VMDiskMetric, error) {
+	var blockStats []struct {
+		Device   string `json:"device"`
+		NodeName string `json:"node-name"`
+		Stats    struct {
+			ReadBytes  int64 `json:"rd_bytes"`
+			WriteBytes int64 `json:"wr_bytes"`
+			ReadOps    int64 `json:"rd_operations"`
+			WriteOps   int64 `json:"wr_operations"`
+		} `json:"stats"`
+	}
+	err := executeQMPCommand(q, "query-blockstats", nil, &blockStats)
+	if err != nil {
+		return nil, err
+	}
+
+	disks := []VMDiskMetric{}
+	for _, b := range blockStats {
+		id := b.Device
+		if id == "" {
+			// hot-plugged volumes
+			id = b.NodeName
+		}
+		if !strings.HasPrefix(id, "drive-") {
+			// e.g. cloud-init ISO and UEFI variable store
+			continue
+		}
+		disks = append(disks, VMDiskMetric{
+			Disk:       strings.TrimPrefix(id, "drive-"),
+			ReadBytes:  b.Stats.ReadBytes,
+			WriteBytes: b.Stats.WriteBytes,
+			ReadOps:    b.Stats.ReadOps,
+			WriteOps:   b.Stats.WriteOps,
+		})
+	}
+	return disks, nil
+}
+
+// getTapCounters returns the rx and tx bytes of the interfaces in the VM network namespace.
+func getTapCounters() (map[string][2]int64, error) {
+	stdouts, err := ExecsStdout([][]string{{"sudo", "ip", "netns", "exec", nsName, "cat", "/proc/net/dev"}})
+	if err != nil {
+		return nil, err
+	}
+
+	counters := map[string][2]int64{}
+	// e.g. "tap-vm1: 1234 10 0 0 0 0 0 0 5678 20 0 0 0 0 0 0"
+	for _, line := range strings.Split(stdouts[0], "\n") {
+		s := strings.SplitN(line, ":", 2)
+		if len(s) != 2 {
+			continue
+		}
+		fields := strings.Fields(s[1])
+		if len(fields) < 9 {
+			continue
+		}
+		rx, _ := strconv.ParseInt(fields[0], 10, 64)
+		tx, _ := strconv.ParseInt(fields[8], 10, 64)
+		counters[strings.TrimSpace(s[0])] = [2]int64{rx, tx}
+	}
+	return counters, nil
+}
+
+func getVMLiveMetric(vm *VMMetaData, tapCounters map[string][2]int64) (*VMLiveMetric, error) {
+	m := &VMLiveMetric{Name: vm.Name, Owner: vm.Owner, Tag: vm.Tag}
+
+	pid, err := readQemuPID(vm.Name)
+	if err != nil {
+		return nil, err
+	}
+	m.CPUSeconds, m.RSSBytes, err = getProcessUsage(pid)
+	if err != nil {
+		return nil, err
+	}
+
+	// the packets received by the tap are the ones the guest transmits
+	for _, nic := range getVMNICs(vm) {
+		if c, ok := tapCounters[nic.IFName]; ok {
+			m.NetRxBytes += c[1]
+			m.NetTxBytes += c[0]
+		}
+	}
+
+	// the main QMP socket accepts only one client, so the scrapes share the connection of the monitor instead
+	m.Disks = []VMDiskMetric{}
+	q := statusCache.getQMP(vm.Name)
+	if q == nil {
+		// VMs launched by older versions have no monitor socket
+		return m, nil
+	}
+	m.Disks, err = queryBlockStats(q)
+	if err != nil {
+		return nil, err
+	}
+	if getHardware(vm).Balloon {
+		// the balloon stats are unavailable until the guest driver is loaded
+		mem, err := queryVMMemoryStats(q)
+		if err != nil {
+			log.Printf("Ignore queryVMMemoryStats error of %s: %v\n", vm.Name, err)
+			return m, nil
+		}
+		m.Memory = mem
+	}
+	return m, nil
+}
+
+// ListVMLiveMetrics returns the resource usage of the running VMs.
+func ListVMLiveMetrics() ([]*VMLiveMetric, error) {
+	vms, err := ListVMs()
+	if err != nil {
+		return nil, err
+	}
+
+	tapCounters, err := getTapCounters()
+	if err != nil {
+		log.Println("Ignore getTapCounters error:", err)
+	}
+
+	ret := []*VMLiveMetric{}
+	for _, vm := range vms {
+		if vm.Status != "running" && vm.Status != "paused" {
+			continue
+		}
+		m, err := getVMLiveMetric(vm, tapCounters)
+		if err != nil {
+			// the VM may have stopped after listed
+			log.Println("Ignore getVMLiveMetric error:", err)
+			continue
+		}
+		ret = append(ret, m)
+	}
+	return ret, nil
+}
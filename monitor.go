@@ -0,0 +1,332 @@
+package minivmm
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/yaamai/govmm/qemu"
+)
+
+var (
+	qmpMonitorSocketFileName = "qmp-monitor.socket"
+	pidFileName              = "qemu.pid"
+
+	monitorInterval = 3 * time.Second
+	// the guest may take a while to shut down after the powerdown request
+	qemuExitTimeout = 90 * time.Second
+	// the VMs without monitor socket are polled on the main QMP socket, so the interval is extended up to this
+	// while their status is unchanged
+	maxPollingInterval = time.Minute
+
+	hostShutdownReason = "shutdown: host-signal"
+	// QEMU disconnected without SHUTDOWN event
+	qemuExitedReason = "qemu exited"
+
+	statusCache = &vmStatusCache{
+		statuses: map[string]string{},
+		monitors: map[string]chan struct{}{},
+		qmps:     map[string]*qemu.QMP{},
+	}
+)
+
+// vmStatusCache keeps the latest VM status observed by monitor goroutines.
+type vmStatusCache struct {
+	mu       sync.Mutex
+	statuses map[string]string
+	// monitors has the channels to wake up the polling monitors
+	monitors map[string]chan struct{}
+	// qmps has the connections to the monitor sockets, which can be shared by the read-only queries
+	qmps map[string]*qemu.QMP
+}
+
+func (c *vmStatusCache) get(name string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	status, ok := c.statuses[name]
+	return status, ok
+}
+
+// set updates the cached status and returns the previous one.
+func (c *vmStatusCache) set(name, status string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	prev := c.statuses[name]
+	c.statuses[name] = status
+	return prev
+}
+
+func (c *vmStatusCache) delete(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.statuses, name)
+	delete(c.monitors, name)
+}
+
+// setQMP keeps the connection to the monitor socket of the VM. nil removes it.
+func (c *vmStatusCache) setQMP(name string, q *qemu.QMP) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if q == nil {
+		delete(c.qmps, name)
+		return
+	}
+	c.qmps[name] = q
+}
+
+// getQMP returns the connection to the monitor socket of the VM, or nil if it's not connected.
+func (c *vmStatusCache) getQMP(name string) *qemu.QMP {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.qmps[name]
+}
+
+// register marks the VM as monitored. It returns nil if the VM is already monitored.
+func (c *vmStatusCache) register(name string) chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.monitors[name]; ok {
+		return nil
+	}
+	wakeCh := make(chan struct{}, 1)
+	c.monitors[name] = wakeCh
+	return wakeCh
+}
+
+// wake makes the monitor of the VM check the status immediately if it's polling.
+func (c *vmStatusCache) wake(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case c.monitors[name] <- struct{}{}:
+	default:
+	}
+}
+
+func getQMPMonitorSocketPath(name string) string {
+	return filepath.Join(C.VMDir, name, qmpMonitorSocketFileName)
+}
+
+func getPIDFilePath(name string) string {
+	return filepath.Join(C.VMDir, name, pidFileName)
+}
+
+// isQemuProcessAlive checks whether the QEMU process written in the pid file is still alive.
+func isQemuProcessAlive(name string) bool {
+	_, ok := readAlivePID(getPIDFilePath(name), "qemu-system")
+	return ok
+}
+
+// waitQemuExit waits for the QEMU process of the VM to exit.
+func waitQemuExit(name string, timeout time.Duration) error {
+	for start := time.Now(); isQemuProcessAlive(name); time.Sleep(500 * time.Millisecond) {
+		if time.Since(start) > timeout {
+			return errors.New("QEMU process does not exit")
+		}
+	}
+	return nil
+}
+
+// readAlivePID returns the pid written in the pid file if the process is alive and its command line contains the command.
+func readAlivePID(pidFilePath, command string) (int, bool) {
+	b, err := os.ReadFile(pidFilePath)
+	if err != nil {
+		return 0, false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0, false
+	}
+	if err := syscall.Kill(pid, 0); err != nil && err != syscall.EPERM {
+		return 0, false
+	}
+
+	// the pid may be reused by other process
+	cmdline, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "cmdline"))
+	if err != nil {
+		return 0, false
+	}
+	if !strings.Contains(string(cmdline), command) {
+		return 0, false
+	}
+	return pid, true
+}
+
+// getOfflineVMStatus returns the status of the VM whose QMP socket is unreachable.
+func getOfflineVMStatus(name string) string {
+	if exists(getVMStatePath(name)) {
+		return "suspended"
+	}
+	if isQemuProcessAlive(name) {
+		return "unknown"
+	}
+	return "stopped"
+}
+
+// updateVMStatus updates the cached status and records the transition into VM metadata.
+func updateVMStatus(name, status, reason string) {
+	prev := statusCache.set(name, status)
+	// the first observation of stopped VM must not overwrite the last status before host reboot
+	if prev == status || (prev == "" && status == "stopped") {
+		return
+	}
+
+	if prev != "" {
+		log.Printf("[monitor] INFO %s: %s -> %s (%s)\n", name, prev, status, reason)
+	}
+	_, err := updateVMMetaData(name, func(metaData *VMMetaData) {
+		if prev != "" {
+			metaData.StatusChangedAt = time.Now()
+			metaData.StatusReason = reason
+		}
+		// the VMs killed by host shutdown keep the last status to be restored on the next boot
+		if reason != hostShutdownReason && status != "unknown" && status != "shutdown" {
+			metaData.LastStatus = status
+		}
+	})
+	if err != nil {
+		log.Println("Ignore updateVMMetaData error:", err)
+	}
+}
+
+// watchVM starts a monitor goroutine for the VM if it is not monitored yet.
+func watchVM(name string) {
+	if wakeCh := statusCache.register(name); wakeCh != nil {
+		go monitorVM(name, wakeCh)
+	}
+}
+
+// notifyVMStatusChange makes the monitor pick up the status changed by minivmm itself, such as start and stop.
+func notifyVMStatusChange(name string) {
+	watchVM(name)
+	statusCache.wake(name)
+}
+
+func monitorVM(name string, wakeCh chan struct{}) {
+	defer statusCache.delete(name)
+
+	supervisor := &vmSupervisor{name: name}
+	pollingInterval := monitorInterval
+	lastPolled := ""
+	unreachable := 0
+	for {
+		if !exists(filepath.Join(C.VMDir, name, vmMetaDataFileName)) {
+			return
+		}
+
+		socketPath := getQMPMonitorSocketPath(name)
+		// the socket is left if QEMU is killed or the host is rebooted
+		if !exists(socketPath) || !isQemuProcessAlive(name) {
+			// stopped VMs and VMs launched by older versions have no monitor socket, so poll their status
+			status := getVMStatus(name)
+			updateVMStatus(name, status, "polling")
+			if status == lastPolled {
+				pollingInterval *= 2
+				if pollingInterval > maxPollingInterval {
+					pollingInterval = maxPollingInterval
+				}
+			} else {
+				pollingInterval = monitorInterval
+			}
+			lastPolled = status
+			select {
+			case <-wakeCh:
+				pollingInterval = monitorInterval
+			case <-time.After(pollingInterval):
+			}
+			continue
+		}
+		pollingInterval = monitorInterval
+		lastPolled = ""
+
+		supervisor.started()
+		reason, err := watchQMPEvents(name, socketPath)
+		if err != nil {
+			updateVMStatus(name, getOfflineVMStatus(name), "qmp unreachable")
+			unreachable++
+			select {
+			case <-wakeCh:
+			case <-time.After(exponentialBackoff(monitorInterval, maxPollingInterval, unreachable)):
+			}
+			continue
+		}
+		unreachable = 0
+		updateVMStatus(name, getOfflineVMStatus(name), reason)
+		if !isQemuProcessAlive(name) {
+			stopTPM(name)
+		}
+		supervisor.handleExit(reason)
+	}
+}
+
+// watchQMPEvents follows the QMP events of the VM until QEMU disconnects, and returns the reason of the disconnection.
+func watchQMPEvents(name, socketPath string) (string, error) {
+	eventCh := make(chan qemu.QMPEvent, 32)
+	disconnectedCh := make(chan struct{})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	q, _, err := qemu.QMPStart(ctx, socketPath, qemu.QMPConfig{EventCh: eventCh}, disconnectedCh)
+	cancel()
+	if err != nil {
+		return "", err
+	}
+	defer q.Shutdown()
+
+	err = q.ExecuteQMPCapabilities(context.Background())
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	statusInfo, err := q.ExecuteQueryStatus(ctx)
+	cancel()
+	if err != nil {
+		return "", err
+	}
+	updateVMStatus(name, statusInfo.Status, "started")
+	statusCache.setQMP(name, q)
+	defer statusCache.setQMP(name, nil)
+
+	reason := qemuExitedReason
+	for {
+		select {
+		case ev := <-eventCh:
+			switch ev.Name {
+			case "STOP":
+				updateVMStatus(name, "paused", "stop")
+			case "RESUME":
+				updateVMStatus(name, "running", "resume")
+			case "RESET":
+				r, _ := ev.Data["reason"].(string)
+				updateVMStatus(name, "running", "reset: "+r)
+			case "SHUTDOWN":
+				r, _ := ev.Data["reason"].(string)
+				reason = "shutdown: " + r
+				updateVMStatus(name, "shutdown", reason)
+			}
+		case <-disconnectedCh:
+			return reason, nil
+		}
+	}
+}
+
+// ReconcileVMStatus keeps monitor goroutines running for all VMs.
+func ReconcileVMStatus() {
+	for {
+		dirEntries, err := os.ReadDir(C.VMDir)
+		if err != nil {
+			log.Println("[monitor] WARN cannot read vm data dir:", err)
+		}
+		for _, f := range dirEntries {
+			if f.IsDir() {
+				watchVM(f.Name())
+			}
+		}
+		time.Sleep(monitorInterval)
+	}
+}
@@ -0,0 +1,152 @@
+package minivmm
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// nftTableName is the nftables table minivmm owns. The other tables are never touched.
+const nftTableName = "minivmm"
+
+func nftSet(values []string) string {
+	if len(values) == 1 {
+		return values[0]
+	}
+	return "{ " + strings.Join(values, ", ") + " }"
+}
+
+func quoteIFNames(names []string) []string {
+	quoted := []string{}
+	for _, n := range names {
+		quoted = append(quoted, fmt.Sprintf("%q", n))
+	}
+	return quoted
+}
+
+// normalizeEgressCIDRs validates the CIDRs and clears their host bits.
+func normalizeEgressCIDRs(cidrs []string) ([]string, error) {
+	ret := []string{}
+	for _, c := range cidrs {
+		ip, ipNet, err := net.ParseCIDR(c)
+		if err != nil || ip.To4() == nil {
+			return nil, errors.Errorf("invalid IPv4 CIDR '%s'", c)
+		}
+		ret = append(ret, ipNet.String())
+	}
+	return ret, nil
+}
+
+// generateNftRuleset renders the NAT and the egress rules of the networks. The ruleset replaces the whole table
+// atomically, so that it can be applied any number of times.
+func generateNftRuleset(networks []*Network) (string, error) {
+	var forward, postrouting []string
+	vethNames := []string{}
+	for _, n := range networks {
+		nwInfo, err := getNetworkInfo(n)
+		if err != nil {
+			return "", errors.Wrapf(err, "network '%s'", n.Name)
+		}
+		allow, err := normalizeEgressCIDRs(n.EgressAllow)
+		if err != nil {
+			return "", errors.Wrapf(err, "network '%s'", n.Name)
+		}
+		deny, err := normalizeEgressCIDRs(n.EgressDeny)
+		if err != nil {
+			return "", errors.Wrapf(err, "network '%s'", n.Name)
+		}
+		veth := fmt.Sprintf("%q", nwInfo.veth[0])
+		vethNames = append(vethNames, nwInfo.veth[0])
+
+		if n.Mode == NetworkModeIsolated {
+			forward = append(forward,
+				fmt.Sprintf("iifname %s drop", veth),
+				fmt.Sprintf("oifname %s drop", veth),
+			)
+			continue
+		}
+		if len(deny) > 0 {
+			forward = append(forward, fmt.Sprintf("iifname %s ip daddr %s drop", veth, nftSet(deny)))
+		}
+		if len(allow) > 0 {
+			forward = append(forward,
+				fmt.Sprintf("iifname %s ip daddr %s accept", veth, nftSet(allow)),
+				fmt.Sprintf("iifname %s drop", veth),
+			)
+		}
+		cidr := nwInfo.cidrIPNet.String()
+		postrouting = append(postrouting, fmt.Sprintf("ip saddr %s ip daddr != %s masquerade", cidr, cidr))
+	}
+	if len(vethNames) > 1 {
+		// the networks are isolated from each other
+		ifNames := nftSet(quoteIFNames(vethNames))
+		forward = append([]string{fmt.Sprintf("iifname %s oifname %s drop", ifNames, ifNames)}, forward...)
+	}
+	// the connections forwarded by the nftables forward backend
+	forward = append([]string{"ct state established,related accept", "ct status dnat accept"}, forward...)
+
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "table inet %s\n", nftTableName)
+	fmt.Fprintf(b, "delete table inet %s\n", nftTableName)
+	fmt.Fprintf(b, "table inet %s {\n", nftTableName)
+	fmt.Fprintf(b, "\tchain forward {\n\t\ttype filter hook forward priority 0; policy accept;\n")
+	for _, r := range forward {
+		fmt.Fprintf(b, "\t\t%s\n", r)
+	}
+	fmt.Fprintf(b, "\t}\n")
+	fmt.Fprintf(b, "\tchain postrouting {\n\t\ttype nat hook postrouting priority 100; policy accept;\n")
+	for _, r := range postrouting {
+		fmt.Fprintf(b, "\t\t%s\n", r)
+	}
+	fmt.Fprintf(b, "\t}\n")
+	fmt.Fprintf(b, "}\n")
+	return b.String(), nil
+}
+
+func runNft(ruleset string) error {
+	if C.NftDryRun {
+		log.Printf("[nft] dry-run:\n%s", ruleset)
+		return nil
+	}
+
+	f, err := os.CreateTemp("", "minivmm-*.nft")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(ruleset)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	return Execs([][]string{{"sudo", "nft", "-f", f.Name()}})
+}
+
+// applyNAT installs the NAT and the egress rules of all networks.
+func applyNAT() error {
+	if C.NoNAT {
+		return nil
+	}
+	networks, err := ListNetworks()
+	if err != nil {
+		return err
+	}
+	ruleset, err := generateNftRuleset(networks)
+	if err != nil {
+		return errors.Wrap(err, "applyNAT")
+	}
+	return errors.Wrap(runNft(ruleset), "applyNAT")
+}
+
+// resetNAT removes the rules installed by applyNAT.
+func resetNAT() error {
+	if C.NoNAT {
+		return nil
+	}
+	// the first line makes the deletion succeed even if the table does not exist
+	return runNft(fmt.Sprintf("table inet %s\ndelete table inet %s\n", nftTableName, nftTableName))
+}
@@ -0,0 +1,48 @@
+package minivmm
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testGenerateNftRuleset(t *testing.T, name string, networks []*Network) {
+	actual, err := generateNftRuleset(networks)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	goldenPath := filepath.Join("testdata", "nft", name+".golden")
+	if *updateGolden {
+		if err := os.WriteFile(goldenPath, []byte(actual), 0644); err != nil {
+			t.Fatalf("failed to update golden file: %v", err)
+		}
+	}
+
+	expected, err := os.ReadFile(goldenPath)
+	if err != nil {
+		t.Fatalf("failed to read golden file: %v", err)
+	}
+	if actual != string(expected) {
+		t.Errorf("ruleset mismatch\nexpected:\n%s\nactual:\n%s", expected, actual)
+	}
+}
+
+func TestGenerateNftRuleset(t *testing.T) {
+	defaultNetwork := &Network{Name: DefaultNetworkName, CIDR: "192.168.200.0/24", Mode: NetworkModeNAT}
+	testGenerateNftRuleset(t, "default", []*Network{defaultNetwork})
+
+	testGenerateNftRuleset(t, "multiple", []*Network{
+		defaultNetwork,
+		{Name: "web", CIDR: "192.168.210.0/24", Mode: NetworkModeNAT, EgressAllow: []string{"10.0.0.0/8", "1.1.1.1/32"}},
+		{Name: "db", CIDR: "192.168.220.0/24", Mode: NetworkModeNAT, EgressDeny: []string{"169.254.169.254/32"}},
+		{Name: "backend", CIDR: "192.168.230.0/24", Mode: NetworkModeIsolated},
+	})
+
+	_, err := generateNftRuleset([]*Network{
+		{Name: DefaultNetworkName, CIDR: "192.168.200.0/24", Mode: NetworkModeNAT, EgressDeny: []string{"fe80::/10"}},
+	})
+	if err == nil {
+		t.Errorf("expected error but it does not occur")
+	}
+}
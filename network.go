@@ -0,0 +1,296 @@
+package minivmm
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultNetworkName is the name of the network given by VMM_SUBNET_CIDR.
+	DefaultNetworkName = "default"
+
+	// NetworkModeNAT lets VMs reach outside of the network via the gateway.
+	NetworkModeNAT = "nat"
+	// NetworkModeIsolated lets VMs reach only the VMs in the same network.
+	NetworkModeIsolated = "isolated"
+)
+
+// the interface names derived from the network name must be within 15 characters
+var networkNameRegexp = regexp.MustCompile(`^[a-z0-9]{1,9}$`)
+
+// Network is a virtual network which VMs are attached to.
+type Network struct {
+	Name      string `json:"name"`
+	Owner     string `json:"owner"`
+	CIDR      string `json:"cidr"`
+	Gateway   string `json:"gateway"`
+	DHCPStart string `json:"dhcp_start"`
+	DHCPEnd   string `json:"dhcp_end"`
+	Mode      string `json:"mode"`
+	// EgressAllow limits the destinations VMs can reach to the CIDRs, if it's not empty.
+	EgressAllow []string `json:"egress_allow"`
+	// EgressDeny is the CIDRs VMs cannot reach.
+	EgressDeny []string `json:"egress_deny"`
+}
+
+// ExtraNIC is a NIC of VM other than the primary one.
+type ExtraNIC struct {
+	Network    string `json:"network"`
+	MacAddress string `json:"mac_address"`
+	IPAddress  string `json:"ip_address"`
+}
+
+// vmNIC is a NIC of VM including the primary one.
+type vmNIC struct {
+	Network         string
+	MacAddress      string
+	IPAddress       string
+	StaticIPAddress string
+	IFName          string
+}
+
+// ErrNetworkNotOwned is returned when a VM is attached to the network of another user.
+var ErrNetworkNotOwned = errors.New("the network is owned by another user")
+
+func defaultNetwork() *Network {
+	return &Network{
+		Name:        DefaultNetworkName,
+		CIDR:        C.SubnetCIDR,
+		Mode:        NetworkModeNAT,
+		EgressAllow: C.EgressAllow,
+		EgressDeny:  C.EgressDeny,
+	}
+}
+
+func getNetworkFilePath(name string) string {
+	return filepath.Join(C.NetworkDir, name+".json")
+}
+
+// GetNetwork returns the network.
+func GetNetwork(name string) (*Network, error) {
+	if name == "" || name == DefaultNetworkName {
+		return defaultNetwork(), nil
+	}
+	if !networkNameRegexp.MatchString(name) {
+		return nil, errors.Errorf("invalid network name '%s'", name)
+	}
+	b, err := os.ReadFile(getNetworkFilePath(name))
+	if os.IsNotExist(err) {
+		return nil, errors.Errorf("network '%s' does not exist", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	n := &Network{}
+	err = json.Unmarshal(b, n)
+	if err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// ListNetworks returns the default network and the networks created by users.
+func ListNetworks() ([]*Network, error) {
+	ret := []*Network{defaultNetwork()}
+
+	dirEntries, err := os.ReadDir(C.NetworkDir)
+	if os.IsNotExist(err) {
+		return ret, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, f := range dirEntries {
+		if !f.IsDir() && strings.HasSuffix(f.Name(), ".json") {
+			names = append(names, strings.TrimSuffix(f.Name(), ".json"))
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		n, err := GetNetwork(name)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, n)
+	}
+	return ret, nil
+}
+
+func isOverlapped(a, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+func validateNetwork(n *Network) error {
+	if !networkNameRegexp.MatchString(n.Name) {
+		return errors.Errorf("invalid network name '%s', it must be 1-9 lowercase letters or digits", n.Name)
+	}
+	if n.Mode != NetworkModeNAT && n.Mode != NetworkModeIsolated {
+		return errors.Errorf("invalid network mode '%s'", n.Mode)
+	}
+	nwInfo, err := getNetworkInfo(n)
+	if err != nil {
+		return err
+	}
+	_, err = normalizeEgressCIDRs(append(append([]string{}, n.EgressAllow...), n.EgressDeny...))
+	if err != nil {
+		return err
+	}
+
+	networks, err := ListNetworks()
+	if err != nil {
+		return err
+	}
+	for _, other := range networks {
+		if other.Name == n.Name {
+			return errors.Errorf("network '%s' already exists", n.Name)
+		}
+		otherInfo, err := getNetworkInfo(other)
+		if err != nil {
+			return err
+		}
+		if isOverlapped(nwInfo.cidrIPNet, otherInfo.cidrIPNet) {
+			return errors.Errorf("%s overlaps the network '%s'", n.CIDR, other.Name)
+		}
+	}
+	return nil
+}
+
+// CreateNetwork creates a network and starts serving DHCP on it.
+func CreateNetwork(n *Network) (*Network, error) {
+	if n.Mode == "" {
+		n.Mode = NetworkModeNAT
+	}
+	err := validateNetwork(n)
+	if err != nil {
+		return nil, errors.Wrap(err, "CreateNetwork")
+	}
+
+	b, err := json.Marshal(n)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(C.NetworkDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	err = os.WriteFile(getNetworkFilePath(n.Name), b, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	err = startNetwork(n)
+	if err != nil {
+		return nil, err
+	}
+	err = applyNAT()
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		err := serveNetworkDHCP(n)
+		if err != nil {
+			log.Printf("[dhcp] WARN %s: %v\n", n.Name, err)
+		}
+	}()
+	return n, nil
+}
+
+// RemoveNetwork removes the network which no VMs are attached to.
+func RemoveNetwork(name string) error {
+	if name == DefaultNetworkName {
+		return errors.New("Cannot remove the default network")
+	}
+	n, err := GetNetwork(name)
+	if err != nil {
+		return errors.Wrap(err, "RemoveNetwork")
+	}
+
+	vms, err := ListVMs()
+	if err != nil {
+		return err
+	}
+	for _, vm := range vms {
+		for _, nic := range getVMNICs(vm) {
+			if nic.Network == name {
+				return errors.Errorf("RemoveNetwork: VM '%s' is attached to the network", vm.Name)
+			}
+		}
+	}
+
+	stopNetworkDHCP(name)
+	nwInfo, err := getNetworkInfo(n)
+	if err != nil {
+		return err
+	}
+	ExecsIgnoreErr(resetNetworkCommands(nwInfo))
+
+	os.Remove(getLeaseFilePathOf(name))
+	err = os.Remove(getNetworkFilePath(name))
+	if err != nil {
+		return err
+	}
+	return applyNAT()
+}
+
+func getNetworkName(name string) string {
+	if name == "" {
+		return DefaultNetworkName
+	}
+	return name
+}
+
+// getVMNICs returns the primary NIC and the extra NICs of VM.
+func getVMNICs(metaData *VMMetaData) []vmNIC {
+	nics := []vmNIC{{
+		Network:         getNetworkName(metaData.Network),
+		MacAddress:      metaData.MacAddress,
+		IPAddress:       metaData.IPAddress,
+		StaticIPAddress: metaData.StaticIPAddress,
+		IFName:          fmt.Sprintf("tap-%s", metaData.Name),
+	}}
+	for i, nic := range metaData.ExtraNICs {
+		nics = append(nics, vmNIC{
+			Network:    getNetworkName(nic.Network),
+			MacAddress: nic.MacAddress,
+			IPAddress:  nic.IPAddress,
+			IFName:     fmt.Sprintf("tap-%s-%d", metaData.Name, i+1),
+		})
+	}
+	return nics
+}
+
+// getNetworkForOwner returns the network if the user can attach VMs to it. The default network has no owner and
+// is shared by all users.
+func getNetworkForOwner(name, owner string) (*Network, error) {
+	n, err := GetNetwork(name)
+	if err != nil {
+		return nil, err
+	}
+	if n.Owner != "" && n.Owner != owner {
+		return nil, errors.Wrapf(ErrNetworkNotOwned, "network '%s'", n.Name)
+	}
+	return n, nil
+}
+
+// newExtraNICs returns the extra NICs attached to the networks.
+func newExtraNICs(networks []string, owner string) ([]ExtraNIC, error) {
+	nics := []ExtraNIC{}
+	for _, name := range networks {
+		n, err := getNetworkForOwner(name, owner)
+		if err != nil {
+			return nil, err
+		}
+		nics = append(nics, ExtraNIC{Network: n.Name, MacAddress: generateMACAddress()})
+	}
+	return nics, nil
+}
@@ -2,16 +2,23 @@ package minivmm
 
 import (
 	"fmt"
+	"log"
 	"net"
 
 	"github.com/apparentlymart/go-cidr/cidr"
+	dhcp "github.com/krolaw/dhcp4"
 )
 
 type vmNetworkInfo struct {
-	cidrIPNet *net.IPNet
-	cidrLen   int
-	gwIP      net.IP
-	startIP   net.IP
+	cidrIPNet  *net.IPNet
+	cidrLen    int
+	gwIP       net.IP
+	startIP    net.IP
+	leaseRange int
+	// router is true if the gateway routes the VM traffic to outside of the network
+	router bool
+	bridge string
+	veth   []string
 }
 
 var (
@@ -21,7 +28,11 @@ var (
 )
 
 func newNetworkInfo() (*vmNetworkInfo, error) {
-	_, cidrIPNet, err := net.ParseCIDR(C.SubnetCIDR)
+	return getNetworkInfo(defaultNetwork())
+}
+
+func getNetworkInfo(n *Network) (*vmNetworkInfo, error) {
+	_, cidrIPNet, err := net.ParseCIDR(n.CIDR)
 	if err != nil {
 		return nil, err
 	}
@@ -39,55 +50,157 @@ func newNetworkInfo() (*vmNetworkInfo, error) {
 	if err != nil {
 		return nil, err
 	}
+	endIP, err := cidr.Host(cidrIPNet, cnt-3)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ip := range []struct {
+		value string
+		dest  *net.IP
+	}{{n.Gateway, &gwIP}, {n.DHCPStart, &startIP}, {n.DHCPEnd, &endIP}} {
+		if ip.value == "" {
+			continue
+		}
+		addr := net.ParseIP(ip.value).To4()
+		if addr == nil || !cidrIPNet.Contains(addr) {
+			return nil, fmt.Errorf("'%s' is not an address of %s", ip.value, n.CIDR)
+		}
+		*ip.dest = addr
+	}
+	leaseRange := dhcp.IPRange(startIP, endIP)
+	if leaseRange <= 0 {
+		return nil, fmt.Errorf("DHCP range %s-%s is empty", startIP, endIP)
+	}
+	if r := dhcp.IPRange(startIP, gwIP); r > 0 && r <= leaseRange {
+		return nil, fmt.Errorf("gateway %s is in the DHCP range", gwIP)
+	}
+
+	bridge, veth := brName, vethNames
+	if n.Name != DefaultNetworkName {
+		bridge = "br-" + n.Name
+		veth = []string{"vmn-" + n.Name, "vmn-" + n.Name + "-p"}
+	}
 
 	return &vmNetworkInfo{
-		cidrIPNet,
-		cidrLen,
-		gwIP,
-		startIP,
+		cidrIPNet:  cidrIPNet,
+		cidrLen:    cidrLen,
+		gwIP:       gwIP,
+		startIP:    startIP,
+		leaseRange: leaseRange,
+		router:     n.Mode != NetworkModeIsolated,
+		bridge:     bridge,
+		veth:       veth,
 	}, nil
 }
 
+func initNetworkCommands(nwInfo *vmNetworkInfo) [][]string {
+	return [][]string{
+		{"sudo", "ip", "link", "add", nwInfo.veth[0], "type", "veth", "peer", "name", nwInfo.veth[1]},
+		{"sudo", "ip", "link", "set", "netns", nsName, "dev", nwInfo.veth[1]},
+
+		{"sudo", "ip", "netns", "exec", nsName, "ip", "link", "add", nwInfo.bridge, "type", "bridge"},
+		{"sudo", "ip", "netns", "exec", nsName, "ip", "link", "set", "master", nwInfo.bridge, "dev", nwInfo.veth[1]},
+	}
+}
+
+func resetNetworkCommands(nwInfo *vmNetworkInfo) [][]string {
+	return [][]string{
+		{"sudo", "ip", "netns", "exec", nsName, "ip", "link", "set", "down", "dev", nwInfo.veth[1]},
+		{"sudo", "ip", "link", "set", "down", "dev", nwInfo.veth[0]},
+
+		{"sudo", "ip", "link", "delete", "dev", nwInfo.veth[0]},
+		{"sudo", "ip", "netns", "exec", nsName, "ip", "link", "delete", nwInfo.bridge},
+	}
+}
+
+func startNetworkCommands(nwInfo *vmNetworkInfo) [][]string {
+	return [][]string{
+		{"sudo", "ip", "link", "set", "up", "dev", nwInfo.veth[0]},
+		{"sudo", "ip", "netns", "exec", nsName, "ip", "link", "set", "up", "dev", nwInfo.veth[1]},
+		{"sudo", "ip", "netns", "exec", nsName, "ip", "link", "set", "promisc", "on", "dev", nwInfo.veth[1]},
+		{"sudo", "ip", "netns", "exec", nsName, "ip", "link", "set", "up", "dev", nwInfo.bridge},
+
+		{"sudo", "ip", "addr", "add", fmt.Sprintf("%s/%d", nwInfo.gwIP.String(), nwInfo.cidrLen), "dev", nwInfo.veth[0]},
+	}
+}
+
 // InitNetns initializes netns.
 func InitNetns() error {
-	return Execs([][]string{
+	nwInfo, err := newNetworkInfo()
+	if err != nil {
+		return err
+	}
+	err = Execs(append([][]string{
 		{"sudo", "ip", "netns", "add", nsName},
-
-		{"sudo", "ip", "link", "add", vethNames[0], "type", "veth", "peer", "name", vethNames[1]},
-		{"sudo", "ip", "link", "set", "netns", nsName, "dev", vethNames[1]},
-
-		{"sudo", "ip", "netns", "exec", nsName, "ip", "link", "add", brName, "type", "bridge"},
-		{"sudo", "ip", "netns", "exec", nsName, "ip", "link", "set", "master", brName, "dev", vethNames[1]},
-	})
+	}, initNetworkCommands(nwInfo)...))
+	if err != nil {
+		return err
+	}
+	return applyNAT()
 }
 
 // ResetNetns removes all netns and interfaces.
 func ResetNetns() error {
-	return Execs([][]string{
-		{"sudo", "ip", "netns", "exec", nsName, "ip", "link", "set", "down", "dev", vethNames[1]},
-		{"sudo", "ip", "link", "set", "down", "dev", vethNames[0]},
+	networks, err := ListNetworks()
+	if err != nil {
+		return err
+	}
+	for _, n := range networks {
+		if n.Name == DefaultNetworkName {
+			continue
+		}
+		nwInfo, err := getNetworkInfo(n)
+		if err != nil {
+			log.Println("Ignore getNetworkInfo error:", err)
+			continue
+		}
+		ExecsIgnoreErr(resetNetworkCommands(nwInfo))
+	}
 
-		{"sudo", "ip", "link", "delete", "dev", vethNames[0]},
-		{"sudo", "ip", "netns", "exec", nsName, "ip", "link", "delete", brName},
+	err = resetNAT()
+	if err != nil {
+		log.Println("Ignore resetNAT error:", err)
+	}
+	err = resetForwardRules()
+	if err != nil {
+		log.Println("Ignore resetForwardRules error:", err)
+	}
 
-		{"sudo", "ip", "netns", "delete", nsName},
-	})
+	nwInfo, err := newNetworkInfo()
+	if err != nil {
+		return err
+	}
+	return Execs(append(resetNetworkCommands(nwInfo),
+		[]string{"sudo", "ip", "netns", "delete", nsName},
+	))
 }
 
 // StartNetwork set up interfaces.
 func StartNetwork() error {
-	nwInfo, err := newNetworkInfo()
+	networks, err := ListNetworks()
 	if err != nil {
 		return err
 	}
+	for _, n := range networks {
+		err = startNetwork(n)
+		if err != nil {
+			return err
+		}
+	}
+	return applyNAT()
+}
 
-	ExecsIgnoreErr([][]string{
-		{"sudo", "ip", "link", "set", "up", "dev", vethNames[0]},
-		{"sudo", "ip", "netns", "exec", nsName, "ip", "link", "set", "up", "dev", vethNames[1]},
-		{"sudo", "ip", "netns", "exec", nsName, "ip", "link", "set", "promisc", "on", "dev", vethNames[1]},
-		{"sudo", "ip", "netns", "exec", nsName, "ip", "link", "set", "up", "dev", brName},
+func startNetwork(n *Network) error {
+	nwInfo, err := getNetworkInfo(n)
+	if err != nil {
+		return err
+	}
 
-		{"sudo", "ip", "addr", "add", fmt.Sprintf("%s/%d", nwInfo.gwIP.String(), nwInfo.cidrLen), "dev", vethNames[0]},
-	})
+	if n.Name != DefaultNetworkName {
+		// the networks created by the API are not set up by InitNetns
+		ExecsIgnoreErr(initNetworkCommands(nwInfo))
+	}
+	ExecsIgnoreErr(startNetworkCommands(nwInfo))
 	return nil
 }
@@ -0,0 +1,88 @@
+package minivmm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// ProxyProtocolV1 is the human-readable PROXY protocol header.
+	ProxyProtocolV1 = "v1"
+	// ProxyProtocolV2 is the binary PROXY protocol header.
+	ProxyProtocolV2 = "v2"
+)
+
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+func validateProxyProtocol(proto, version string) error {
+	switch version {
+	case "":
+		return nil
+	case ProxyProtocolV1, ProxyProtocolV2:
+		if proto != "tcp" {
+			return errors.New("PROXY protocol is supported only for tcp")
+		}
+		return nil
+	}
+	return errors.Errorf("unknown PROXY protocol version '%s'", version)
+}
+
+// generateProxyProtocolHeader returns the header which tells the client address src and the address dst
+// the client connected to. If they are not TCP addresses, the header tells the addresses are unknown.
+func generateProxyProtocolHeader(version string, src, dst net.Addr) ([]byte, error) {
+	srcAddr, srcOK := src.(*net.TCPAddr)
+	dstAddr, dstOK := dst.(*net.TCPAddr)
+	known := srcOK && dstOK
+	v4 := known && srcAddr.IP.To4() != nil && dstAddr.IP.To4() != nil
+
+	switch version {
+	case ProxyProtocolV1:
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n"), nil
+		}
+		if v4 {
+			return []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", srcAddr.IP.To4(), dstAddr.IP.To4(), srcAddr.Port, dstAddr.Port)), nil
+		}
+		return []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", srcAddr.IP.To16(), dstAddr.IP.To16(), srcAddr.Port, dstAddr.Port)), nil
+
+	case ProxyProtocolV2:
+		b := bytes.NewBuffer(append([]byte{}, proxyProtocolV2Signature...))
+		if !known {
+			// LOCAL command with no address
+			b.Write([]byte{0x20, 0x00, 0x00, 0x00})
+			return b.Bytes(), nil
+		}
+		var srcIP, dstIP net.IP
+		if v4 {
+			// PROXY command, TCP over IPv4
+			b.Write([]byte{0x21, 0x11})
+			srcIP, dstIP = srcAddr.IP.To4(), dstAddr.IP.To4()
+		} else {
+			// PROXY command, TCP over IPv6
+			b.Write([]byte{0x21, 0x21})
+			srcIP, dstIP = srcAddr.IP.To16(), dstAddr.IP.To16()
+		}
+		binary.Write(b, binary.BigEndian, uint16(len(srcIP)*2+4))
+		b.Write(srcIP)
+		b.Write(dstIP)
+		binary.Write(b, binary.BigEndian, uint16(srcAddr.Port))
+		binary.Write(b, binary.BigEndian, uint16(dstAddr.Port))
+		return b.Bytes(), nil
+	}
+	return nil, errors.Errorf("unknown PROXY protocol version '%s'", version)
+}
+
+// writeProxyProtocolHeader sends the header of the client connection src to the upstream dst.
+func writeProxyProtocolHeader(dst io.Writer, version string, src net.Conn) error {
+	header, err := generateProxyProtocolHeader(version, src.RemoteAddr(), src.LocalAddr())
+	if err != nil {
+		return err
+	}
+	_, err = dst.Write(header)
+	return err
+}
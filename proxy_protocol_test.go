@@ -0,0 +1,56 @@
+package minivmm
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestGenerateProxyProtocolHeader(t *testing.T) {
+	src4 := &net.TCPAddr{IP: net.ParseIP("203.0.113.10"), Port: 51234}
+	dst4 := &net.TCPAddr{IP: net.ParseIP("::ffff:198.51.100.1"), Port: 10022}
+	src6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::10"), Port: 51234}
+	dst6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 10022}
+	unknown := &net.UnixAddr{Name: "/tmp/sock", Net: "unix"}
+
+	for _, c := range []struct {
+		version  string
+		src, dst net.Addr
+		expected []byte
+	}{
+		{ProxyProtocolV1, src4, dst4, []byte("PROXY TCP4 203.0.113.10 198.51.100.1 51234 10022\r\n")},
+		{ProxyProtocolV1, src6, dst6, []byte("PROXY TCP6 2001:db8::10 2001:db8::1 51234 10022\r\n")},
+		{ProxyProtocolV1, unknown, dst4, []byte("PROXY UNKNOWN\r\n")},
+		{ProxyProtocolV2, src4, dst4, append(append([]byte{}, proxyProtocolV2Signature...),
+			0x21, 0x11, 0x00, 0x0c,
+			203, 0, 113, 10,
+			198, 51, 100, 1,
+			0xc8, 0x22, 0x27, 0x26,
+		)},
+		{ProxyProtocolV2, unknown, dst4, append(append([]byte{}, proxyProtocolV2Signature...), 0x20, 0x00, 0x00, 0x00)},
+	} {
+		actual, err := generateProxyProtocolHeader(c.version, c.src, c.dst)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+			continue
+		}
+		if !bytes.Equal(actual, c.expected) {
+			t.Errorf("header mismatch for %s %v %v\nexpected: %q\nactual:   %q", c.version, c.src, c.dst, c.expected, actual)
+		}
+	}
+
+	header, err := generateProxyProtocolHeader(ProxyProtocolV2, src6, dst6)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(header) != 16+36 || header[13] != 0x21 || header[15] != 36 {
+		t.Errorf("unexpected IPv6 header: %q", header)
+	}
+
+	if err := validateProxyProtocol("udp", ProxyProtocolV1); err == nil {
+		t.Errorf("expected error but it does not occur")
+	}
+	if err := validateProxyProtocol("tcp", "v3"); err == nil {
+		t.Errorf("expected error but it does not occur")
+	}
+}
@@ -0,0 +1,202 @@
+package minivmm
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+
+	"github.com/pkg/errors"
+	"github.com/yaamai/govmm/qemu"
+)
+
+// QoS is the I/O limits of VM.
+type QoS struct {
+	// Disk is the limits applied to each disk.
+	Disk DiskQoS `json:"disk"`
+	// Disks overrides the limits of the disks by ID, "root" or the name of an extra volume.
+	Disks map[string]DiskQoS `json:"disks"`
+	NIC   NICQoS             `json:"nic"`
+}
+
+// DiskQoS is the throttling of a disk. 0 means unlimited.
+type DiskQoS struct {
+	IOPS      int64 `json:"iops"`
+	IOPSRead  int64 `json:"iops_read"`
+	IOPSWrite int64 `json:"iops_write"`
+	BPS       int64 `json:"bps"`
+	BPSRead   int64 `json:"bps_read"`
+	BPSWrite  int64 `json:"bps_write"`
+}
+
+// NICQoS is the bandwidth limits of the NIC in the tc rate format like "100mbit". Empty means unlimited.
+type NICQoS struct {
+	// RxRate limits the traffic the guest receives.
+	RxRate string `json:"rx_rate"`
+	// TxRate limits the traffic the guest transmits.
+	TxRate string `json:"tx_rate"`
+}
+
+var tcRateRegexp = regexp.MustCompile(`^[0-9]+(bit|kbit|mbit|gbit|bps|kbps|mbps|gbps)$`)
+
+func (d DiskQoS) validate() error {
+	for _, v := range []int64{d.IOPS, d.IOPSRead, d.IOPSWrite, d.BPS, d.BPSRead, d.BPSWrite} {
+		if v < 0 {
+			return errors.New("disk limits must not be negative")
+		}
+	}
+	// QEMU rejects the total limit with the read or write one
+	if (d.IOPS > 0 && (d.IOPSRead > 0 || d.IOPSWrite > 0)) || (d.BPS > 0 && (d.BPSRead > 0 || d.BPSWrite > 0)) {
+		return errors.New("total limit cannot be used with read or write limit")
+	}
+	return nil
+}
+
+func (qos *QoS) validate() error {
+	err := qos.Disk.validate()
+	if err != nil {
+		return err
+	}
+	for _, d := range qos.Disks {
+		err = d.validate()
+		if err != nil {
+			return err
+		}
+	}
+	for _, rate := range []string{qos.NIC.RxRate, qos.NIC.TxRate} {
+		if rate != "" && !tcRateRegexp.MatchString(rate) {
+			return errors.Errorf("invalid rate '%s'", rate)
+		}
+	}
+	return nil
+}
+
+// getDiskQoS returns the limits of the disk.
+func getDiskQoS(qos *QoS, id string) DiskQoS {
+	if qos == nil {
+		return DiskQoS{}
+	}
+	if d, ok := qos.Disks[id]; ok {
+		return d
+	}
+	return qos.Disk
+}
+
+// driveOptions returns the throttling options of -drive.
+func (d DiskQoS) driveOptions() string {
+	opts := ""
+	for _, o := range []struct {
+		name  string
+		value int64
+	}{
+		{"iops-total", d.IOPS},
+		{"iops-read", d.IOPSRead},
+		{"iops-write", d.IOPSWrite},
+		{"bps-total", d.BPS},
+		{"bps-read", d.BPSRead},
+		{"bps-write", d.BPSWrite},
+	} {
+		if o.value > 0 {
+			opts += fmt.Sprintf(",throttling.%s=%d", o.name, o.value)
+		}
+	}
+	return opts
+}
+
+// setDiskQoS applies the limits to the disk of the running VM.
+func setDiskQoS(q *qemu.QMP, id string, d DiskQoS) error {
+	return executeQMPCommand(q, "block_set_io_throttle", map[string]interface{}{
+		"id":      getDiskDeviceID(id),
+		"iops":    d.IOPS,
+		"iops_rd": d.IOPSRead,
+		"iops_wr": d.IOPSWrite,
+		"bps":     d.BPS,
+		"bps_rd":  d.BPSRead,
+		"bps_wr":  d.BPSWrite,
+	}, nil)
+}
+
+// setNICQoS applies the limits to the tap device of the running VM. The egress of the tap is shaped,
+// and the ingress of it is policed because it cannot be queued.
+func setNICQoS(ifName string, n NICQoS) error {
+	tc := []string{"sudo", "ip", "netns", "exec", nsName, "tc"}
+	cmd := func(args ...string) []string { return append(append([]string{}, tc...), args...) }
+
+	ExecsIgnoreErr([][]string{
+		cmd("qdisc", "del", "dev", ifName, "root"),
+		cmd("qdisc", "del", "dev", ifName, "ingress"),
+	})
+
+	cmds := [][]string{}
+	if n.RxRate != "" {
+		cmds = append(cmds, cmd("qdisc", "add", "dev", ifName, "root", "tbf", "rate", n.RxRate, "burst", "64kb", "latency", "400ms"))
+	}
+	if n.TxRate != "" {
+		cmds = append(cmds,
+			cmd("qdisc", "add", "dev", ifName, "handle", "ffff:", "ingress"),
+			cmd("filter", "add", "dev", ifName, "parent", "ffff:", "protocol", "all", "u32", "match", "u32", "0", "0",
+				"police", "rate", n.TxRate, "burst", "64kb", "drop", "flowid", ":1"),
+		)
+	}
+	return Execs(cmds)
+}
+
+// setNICsQoS applies the limits to the tap devices of all NICs of the running VM.
+func setNICsQoS(metaData *VMMetaData, n NICQoS) error {
+	for _, nic := range getVMNICs(metaData) {
+		err := setNICQoS(nic.IFName, n)
+		if err != nil {
+			return errors.Wrapf(err, "failed to shape '%s'", nic.IFName)
+		}
+	}
+	return nil
+}
+
+// applyQoS applies the limits to all disks and NICs of the running VM.
+func applyQoS(name string, metaData *VMMetaData) error {
+	if metaData.QoS == nil {
+		return nil
+	}
+	if isDiskHotpluggable(getHardware(metaData)) {
+		err := withQMP(name, func(q *qemu.QMP) error {
+			for _, disk := range getVolumeDisks(metaData) {
+				err := setDiskQoS(q, disk.ID, getDiskQoS(metaData.QoS, disk.ID))
+				if err != nil {
+					return errors.Wrapf(err, "failed to throttle '%s'", disk.ID)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	} else {
+		log.Printf("[qos] WARN %s: disk limits are applied on the next boot\n", name)
+	}
+	return setNICsQoS(metaData, metaData.QoS.NIC)
+}
+
+// SetVMQoS updates the I/O limits of VM. The limits are applied to the running VM immediately.
+func SetVMQoS(name string, qos *QoS) (*VMMetaData, error) {
+	metaData, err := GetVM(name)
+	if err != nil {
+		return nil, errors.Wrap(err, "SetVMQoS: Failed to get VM metadata")
+	}
+	err = qos.validate()
+	if err != nil {
+		return nil, errors.Wrap(err, "SetVMQoS")
+	}
+
+	metaData.QoS = qos
+	err = saveVMMetaData(name, metaData)
+	if err != nil {
+		return nil, err
+	}
+
+	if metaData.Status == "running" || metaData.Status == "paused" {
+		err = applyQoS(name, metaData)
+		if err != nil {
+			return nil, errors.Wrap(err, "SetVMQoS")
+		}
+	}
+	return metaData, nil
+}
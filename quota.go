@@ -0,0 +1,349 @@
+package minivmm
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Quota is the limits of resources per user. 0 means unlimited.
+type Quota struct {
+	VMs          int    `json:"vms"`
+	CPU          int    `json:"cpu"`
+	Memory       string `json:"memory"`
+	Disk         string `json:"disk"`
+	Forwards     int    `json:"forwards"`
+	ExtraVolumes int    `json:"extra_volumes"`
+}
+
+// QuotaDefinitions is the content of the quota file.
+type QuotaDefinitions struct {
+	// Default is applied to the users not in Users.
+	Default Quota            `json:"default"`
+	Users   map[string]Quota `json:"users"`
+}
+
+// QuotaUsage is the usage of resources per user. Memory and disk are in bytes.
+type QuotaUsage struct {
+	VMs          int   `json:"vms"`
+	CPU          int   `json:"cpu"`
+	Memory       int64 `json:"memory"`
+	Disk         int64 `json:"disk"`
+	Forwards     int   `json:"forwards"`
+	ExtraVolumes int   `json:"extra_volumes"`
+}
+
+// QuotaExceededError is returned when a request exceeds the user's quota.
+type QuotaExceededError struct {
+	Resource string
+	Limit    int64
+	Usage    int64
+	Request  int64
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("quota exceeded: %s limit %d, usage %d, requested %d", e.Resource, e.Limit, e.Usage, e.Request)
+}
+
+// LoadQuotaDefinitions reads the quota file. If it does not exist, all users are unlimited.
+func LoadQuotaDefinitions() (*QuotaDefinitions, error) {
+	defs := &QuotaDefinitions{Users: map[string]Quota{}}
+	b, err := os.ReadFile(C.QuotaFile)
+	if os.IsNotExist(err) {
+		return defs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(b, defs)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid quota file")
+	}
+	return defs, nil
+}
+
+// GetQuota returns the quota of the user.
+func GetQuota(user string) (*Quota, error) {
+	defs, err := LoadQuotaDefinitions()
+	if err != nil {
+		return nil, err
+	}
+	if q, ok := defs.Users[user]; ok {
+		return &q, nil
+	}
+	return &defs.Default, nil
+}
+
+func parseBytes(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	s, err := ConvertSIPrefixedValue(value, "")
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+// parseMemoryBytes parses the memory size in bytes. A value without unit is in MiB as QEMU reads it.
+func parseMemoryBytes(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	mebi, err := convertMebi(value)
+	if err != nil {
+		return 0, err
+	}
+	return int64(mebi) << 20, nil
+}
+
+// getVMDiskBytes returns the root disk size of the VM. The VMs created without disk size have the image's size.
+func getVMDiskBytes(vm *VMMetaData) (int64, error) {
+	if vm.Disk != "" || vm.Volume == "" {
+		return parseBytes(vm.Disk)
+	}
+	info, err := getImageInfo(vm.Volume)
+	if err != nil {
+		return 0, err
+	}
+	return info.VirtualSize, nil
+}
+
+// GetQuotaUsage returns the resources allocated to the user's VMs and forwards.
+func GetQuotaUsage(user string) (*QuotaUsage, error) {
+	vms, err := ListVMs()
+	if err != nil {
+		return nil, err
+	}
+
+	u := &QuotaUsage{}
+	for _, vm := range vms {
+		if vm.Owner != user {
+			continue
+		}
+		u.VMs++
+		cpu, err := strconv.Atoi(vm.CPU)
+		if err != nil {
+			log.Printf("failed to parse cpu info, %v\n", err)
+		}
+		u.CPU += cpu
+		mem, err := parseMemoryBytes(vm.Memory)
+		if err != nil {
+			log.Printf("failed to parse memory info, %v\n", err)
+		}
+		u.Memory += mem
+		disk, err := getVMDiskBytes(vm)
+		if err != nil {
+			log.Printf("failed to parse disk info, %v\n", err)
+		}
+		u.Disk += disk
+		for _, vol := range vm.ExtraVolumes {
+			size, err := parseBytes(vol.Size)
+			if err != nil {
+				log.Printf("failed to parse volume size, %v\n", err)
+			}
+			u.Disk += size
+			u.ExtraVolumes++
+		}
+	}
+
+	forwards, err := ReadAllForwardFiles()
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range forwards {
+		if f.Owner == user {
+			u.Forwards++
+		}
+	}
+	return u, nil
+}
+
+// QuotaRequest is the amount of resources requested additionally.
+type QuotaRequest struct {
+	VMs          int
+	CPU          int
+	Memory       int64
+	Disk         int64
+	Forwards     int
+	ExtraVolumes int
+}
+
+// quotaReservations is the resources being allocated per user. They are counted as the usage until the allocation
+// is saved, so that concurrent requests cannot exceed the quota together.
+var quotaReservations = struct {
+	sync.Mutex
+	m map[string]QuotaRequest
+}{m: map[string]QuotaRequest{}}
+
+// increase returns the request without decreases. Decreases are not reserved because they are not applied until
+// they are saved.
+func (r QuotaRequest) increase() QuotaRequest {
+	nonNegative := func(v int64) int64 {
+		if v < 0 {
+			return 0
+		}
+		return v
+	}
+	return QuotaRequest{
+		VMs:          int(nonNegative(int64(r.VMs))),
+		CPU:          int(nonNegative(int64(r.CPU))),
+		Memory:       nonNegative(r.Memory),
+		Disk:         nonNegative(r.Disk),
+		Forwards:     int(nonNegative(int64(r.Forwards))),
+		ExtraVolumes: int(nonNegative(int64(r.ExtraVolumes))),
+	}
+}
+
+func (r QuotaRequest) add(o QuotaRequest, sign int) QuotaRequest {
+	r.VMs += o.VMs * sign
+	r.CPU += o.CPU * sign
+	r.Memory += o.Memory * int64(sign)
+	r.Disk += o.Disk * int64(sign)
+	r.Forwards += o.Forwards * sign
+	r.ExtraVolumes += o.ExtraVolumes * sign
+	return r
+}
+
+// CheckQuota checks the user's quota allows the request.
+func CheckQuota(user string, req QuotaRequest) error {
+	quotaReservations.Lock()
+	defer quotaReservations.Unlock()
+	return checkQuota(user, req)
+}
+
+// ReserveQuota checks the user's quota allows the request and reserves it. The returned function releases the
+// reservation and must be called after the allocated resources are saved. It can be called more than once.
+func ReserveQuota(user string, req QuotaRequest) (func(), error) {
+	quotaReservations.Lock()
+	defer quotaReservations.Unlock()
+	err := checkQuota(user, req)
+	if err != nil {
+		return nil, err
+	}
+	inc := req.increase()
+	quotaReservations.m[user] = quotaReservations.m[user].add(inc, 1)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			quotaReservations.Lock()
+			defer quotaReservations.Unlock()
+			quotaReservations.m[user] = quotaReservations.m[user].add(inc, -1)
+		})
+	}, nil
+}
+
+func checkQuota(user string, req QuotaRequest) error {
+	quota, err := GetQuota(user)
+	if err != nil {
+		return err
+	}
+	usage, err := GetQuotaUsage(user)
+	if err != nil {
+		return err
+	}
+	reserved := quotaReservations.m[user]
+	usage.VMs += reserved.VMs
+	usage.CPU += reserved.CPU
+	usage.Memory += reserved.Memory
+	usage.Disk += reserved.Disk
+	usage.Forwards += reserved.Forwards
+	usage.ExtraVolumes += reserved.ExtraVolumes
+
+	maxMemory, err := parseMemoryBytes(quota.Memory)
+	if err != nil {
+		return errors.Wrap(err, "invalid memory quota")
+	}
+	maxDisk, err := parseBytes(quota.Disk)
+	if err != nil {
+		return errors.Wrap(err, "invalid disk quota")
+	}
+
+	for _, c := range []struct {
+		resource string
+		limit    int64
+		usage    int64
+		request  int64
+	}{
+		{"vms", int64(quota.VMs), int64(usage.VMs), int64(req.VMs)},
+		{"cpu", int64(quota.CPU), int64(usage.CPU), int64(req.CPU)},
+		{"memory", maxMemory, usage.Memory, req.Memory},
+		{"disk", maxDisk, usage.Disk, req.Disk},
+		{"forwards", int64(quota.Forwards), int64(usage.Forwards), int64(req.Forwards)},
+		{"extra_volumes", int64(quota.ExtraVolumes), int64(usage.ExtraVolumes), int64(req.ExtraVolumes)},
+	} {
+		// shrinking is always allowed even if the usage is over the limit
+		if c.limit == 0 || c.request <= 0 {
+			continue
+		}
+		if c.usage+c.request > c.limit {
+			return &QuotaExceededError{Resource: c.resource, Limit: c.limit, Usage: c.usage, Request: c.request}
+		}
+	}
+	return nil
+}
+
+// newQuotaRequest returns the request for the VM of the size.
+func newQuotaRequest(cpu, memory, disk string) (QuotaRequest, error) {
+	req := QuotaRequest{}
+	var err error
+	if cpu != "" {
+		req.CPU, err = strconv.Atoi(cpu)
+		if err != nil {
+			return req, errors.Errorf("invalid cpu '%s'", cpu)
+		}
+	}
+	req.Memory, err = parseMemoryBytes(memory)
+	if err != nil {
+		return req, err
+	}
+	req.Disk, err = parseBytes(disk)
+	if err != nil {
+		return req, err
+	}
+	return req, nil
+}
+
+// newResizeRequest returns the difference of the resources to resize the VM. Empty values mean unchanged.
+func newResizeRequest(metaData *VMMetaData, cpu, memory, disk string) (QuotaRequest, error) {
+	cur, err := newQuotaRequest(metaData.CPU, metaData.Memory, "")
+	if err != nil {
+		return cur, err
+	}
+	if disk != "" {
+		cur.Disk, err = getVMDiskBytes(metaData)
+		if err != nil {
+			return cur, err
+		}
+	}
+	req, err := newQuotaRequest(cpu, memory, disk)
+	if err != nil {
+		return req, err
+	}
+	if cpu != "" {
+		req.CPU -= cur.CPU
+	}
+	if memory != "" {
+		req.Memory -= cur.Memory
+	}
+	if disk != "" {
+		req.Disk -= cur.Disk
+	}
+	return req, nil
+}
+
+// reserveResizeQuota checks the quota allows the VM to be resized and reserves the increase.
+// Empty values mean unchanged.
+func reserveResizeQuota(metaData *VMMetaData, cpu, memory, disk string) (func(), error) {
+	req, err := newResizeRequest(metaData, cpu, memory, disk)
+	if err != nil {
+		return nil, err
+	}
+	return ReserveQuota(metaData.Owner, req)
+}
@@ -0,0 +1,134 @@
+package minivmm
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func setupQuotaTest(t *testing.T) {
+	dir := t.TempDir()
+	SetConfig(&Config{
+		Dir:        dir,
+		VMDir:      filepath.Join(dir, "vms"),
+		ForwardDir: filepath.Join(dir, "forwards"),
+		QuotaFile:  filepath.Join(dir, "quotas.json"),
+	})
+	os.MkdirAll(C.VMDir, 0755)
+	os.MkdirAll(C.ForwardDir, 0755)
+
+	quotas := `{"default": {"vms": 2, "cpu": 4, "memory": "4G", "disk": "20G", "forwards": 1, "extra_volumes": 1},
+		"users": {"admin": {}}}`
+	if err := os.WriteFile(C.QuotaFile, []byte(quotas), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err := saveVMMetaData("vm1", &VMMetaData{Name: "vm1", Owner: "user", CPU: "2", Memory: "2G", Disk: "10G",
+		ExtraVolumes: []ExtraVolume{{Name: "extra-volume1", Size: "5G"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckQuota(t *testing.T) {
+	setupQuotaTest(t)
+
+	for _, c := range []struct {
+		name     string
+		user     string
+		req      QuotaRequest
+		resource string
+	}{
+		{"fit", "user", QuotaRequest{VMs: 1, CPU: 2, Memory: 2 << 30, Disk: 5 << 30}, ""},
+		{"vms", "user", QuotaRequest{VMs: 2}, "vms"},
+		{"cpu", "user", QuotaRequest{CPU: 3}, "cpu"},
+		{"memory", "user", QuotaRequest{Memory: 2<<30 + 1}, "memory"},
+		{"disk", "user", QuotaRequest{Disk: 5<<30 + 1}, "disk"},
+		{"forwards", "user", QuotaRequest{Forwards: 2}, "forwards"},
+		{"extra volumes", "user", QuotaRequest{ExtraVolumes: 1}, "extra_volumes"},
+		{"shrink", "user", QuotaRequest{CPU: -1, ExtraVolumes: -1}, ""},
+		{"other user", "other", QuotaRequest{VMs: 2, CPU: 4}, ""},
+		{"unlimited", "admin", QuotaRequest{VMs: 100, CPU: 100}, ""},
+	} {
+		err := CheckQuota(c.user, c.req)
+		if c.resource == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", c.name, err)
+			}
+			continue
+		}
+		e, ok := err.(*QuotaExceededError)
+		if !ok {
+			t.Errorf("%s: expected QuotaExceededError but got %v", c.name, err)
+			continue
+		}
+		if e.Resource != c.resource {
+			t.Errorf("%s: unexpected resource; expected:%s actual:%s", c.name, c.resource, e.Resource)
+		}
+	}
+}
+
+func TestReserveQuota(t *testing.T) {
+	setupQuotaTest(t)
+
+	release, err := ReserveQuota("user", QuotaRequest{VMs: 1})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := CheckQuota("user", QuotaRequest{VMs: 1}); err == nil {
+		t.Errorf("expected the reserved VM to be counted")
+	}
+	release()
+	release()
+	if err := CheckQuota("user", QuotaRequest{VMs: 1}); err != nil {
+		t.Errorf("unexpected error after release: %v", err)
+	}
+}
+
+func TestReserveResizeQuota(t *testing.T) {
+	setupQuotaTest(t)
+	vm, err := loadVMMetaData("vm1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name                string
+		cpu, memory, disk   string
+		expectQuotaExceeded bool
+	}{
+		{"unchanged", "", "", "", false},
+		{"grow to limit", "4", "4G", "15G", false},
+		{"cpu", "5", "", "", true},
+		{"memory", "", "5G", "", true},
+		{"disk", "", "", "16G", true},
+		{"shrink", "1", "1G", "", false},
+		{"memory without unit", "", "4096", "", false},
+		{"memory without unit exceeded", "", "4097", "", true},
+	} {
+		release, err := reserveResizeQuota(vm, c.cpu, c.memory, c.disk)
+		if c.expectQuotaExceeded {
+			if _, ok := err.(*QuotaExceededError); !ok {
+				t.Errorf("%s: expected QuotaExceededError but got %v", c.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", c.name, err)
+			continue
+		}
+		release()
+	}
+}
+
+func TestParseMemoryBytes(t *testing.T) {
+	for value, expected := range map[string]int64{"": 0, "2048": 2 << 30, "2G": 2 << 30, "512M": 512 << 20} {
+		actual, err := parseMemoryBytes(value)
+		if err != nil {
+			t.Errorf("unexpected error for '%s': %v", value, err)
+		}
+		if actual != expected {
+			t.Errorf("unexpected bytes of '%s'; expected:%d actual:%d", value, expected, actual)
+		}
+	}
+}
@@ -55,7 +55,7 @@ fi
 # Setup service user
 grep -q $USR /etc/passwd || $sudo useradd $USR -b $(dirname $VMM_DIR)
 echo "Defaults:$USR !requiretty" | $sudo tee /etc/sudoers.d/$USR > /dev/null
-echo "$USR ALL=(ALL) NOPASSWD:/sbin/ip" | $sudo tee /etc/sudoers.d/$USR > /dev/null
+echo "$USR ALL=(ALL) NOPASSWD:/sbin/ip,/usr/sbin/nft" | $sudo tee /etc/sudoers.d/$USR > /dev/null
 $sudo chmod 440 /etc/sudoers.d/$USR
 
 # Setup data directory
@@ -93,6 +93,3 @@ EOS
 
 $sudo systemctl enable minivmm.service
 $sudo systemctl start minivmm.service
-
-default_dev=$(ip route | grep "^default" | sed -e 's|.*\(dev.*\)|\1|' | awk '{print $2}')
-$sudo iptables -t nat -A POSTROUTING -o $default_dev -s ${VMM_SUBNET_CIDR} -j MASQUERADE
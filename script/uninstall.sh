@@ -10,7 +10,8 @@ fi
 
 default_dev=$(ip route | grep "^default" | sed -e 's|.*\(dev.*\)|\1|' | awk '{print $2}')
 subnet_cidr=$(grep VMM_SUBNET_CIDR $(grep EnvironmentFile /etc/systemd/system/minivmm.service | cut -d= -f2) | cut -d= -f2)
-$sudo iptables -t nat -D POSTROUTING -o $default_dev -s $subnet_cidr -j MASQUERADE
+# the rule has been added by older installers
+$sudo iptables -t nat -D POSTROUTING -o $default_dev -s $subnet_cidr -j MASQUERADE || true
 
 $sudo systemctl stop minivmm.service
 $sudo systemctl disable minivmm.service
@@ -0,0 +1,249 @@
+package minivmm
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/yaamai/govmm/qemu"
+)
+
+// Snapshot is VM snapshot's metadata.
+type Snapshot struct {
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	Volumes   []string  `json:"volumes"`
+}
+
+func getVolumePaths(metaData *VMMetaData) []string {
+	paths := []string{metaData.Volume}
+	for _, vol := range metaData.ExtraVolumes {
+		paths = append(paths, vol.Path)
+	}
+	return paths
+}
+
+// getVolumeDisks returns the root volume and extra volumes of the VM as disks.
+func getVolumeDisks(metaData *VMMetaData) []qemuDisk {
+	disks := []qemuDisk{{ID: "root", Path: metaData.Volume, QoS: getDiskQoS(metaData.QoS, "root")}}
+	for _, vol := range metaData.ExtraVolumes {
+		disks = append(disks, qemuDisk{ID: vol.Name, Path: vol.Path, QoS: getDiskQoS(metaData.QoS, vol.Name)})
+	}
+	return disks
+}
+
+func findSnapshot(metaData *VMMetaData, snapName string) (int, *Snapshot) {
+	for i := range metaData.Snapshots {
+		if metaData.Snapshots[i].Name == snapName {
+			return i, &metaData.Snapshots[i]
+		}
+	}
+	return -1, nil
+}
+
+// getBlockDevicesByPath returns a map of image file path to QMP block device name.
+func getBlockDevicesByPath(q *qemu.QMP) (map[string]string, error) {
+	var blocks []struct {
+		Device   string `json:"device"`
+		Inserted struct {
+			File     string `json:"file"`
+			NodeName string `json:"node-name"`
+		} `json:"inserted"`
+	}
+	err := executeQMPCommand(q, "query-block", nil, &blocks)
+	if err != nil {
+		return nil, err
+	}
+
+	devices := map[string]string{}
+	for _, b := range blocks {
+		if b.Inserted.File == "" {
+			continue
+		}
+		// hot-plugged volumes have no legacy device name
+		if b.Device == "" {
+			devices[b.Inserted.File] = b.Inserted.NodeName
+		} else {
+			devices[b.Inserted.File] = b.Device
+		}
+	}
+	return devices, nil
+}
+
+// executeSnapshotQMPCommand executes an internal snapshot command for each volume on a running VM.
+// If it fails on a volume, undoCmd is executed on the volumes already done unless undoCmd is empty.
+func executeSnapshotQMPCommand(name, cmd, undoCmd, snapName string, paths []string) error {
+	q, _, err := initQMP(getQMPSocketPath(name))
+	if err != nil {
+		return err
+	}
+	defer q.Shutdown()
+
+	devices, err := getBlockDevicesByPath(q)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range paths {
+		if _, ok := devices[p]; !ok {
+			return fmt.Errorf("block device for '%s' is not found", p)
+		}
+	}
+	for i, p := range paths {
+		err = executeQMPCommand(q, cmd, map[string]interface{}{"device": devices[p], "name": snapName}, nil)
+		if err != nil {
+			if undoCmd != "" {
+				for _, done := range paths[:i] {
+					undoErr := executeQMPCommand(q, undoCmd, map[string]interface{}{"device": devices[done], "name": snapName}, nil)
+					if undoErr != nil {
+						log.Printf("Ignore %s error: %v\n", undoCmd, undoErr)
+					}
+				}
+			}
+			return errors.Wrapf(err, "%s failed on '%s'", cmd, devices[p])
+		}
+	}
+	return nil
+}
+
+// ListSnapshots returns a list of snapshots of the VM.
+func ListSnapshots(name string) ([]Snapshot, error) {
+	metaData, err := loadVMMetaData(name)
+	if err != nil {
+		return nil, errors.Wrap(err, "ListSnapshots: Failed to get VM metadata")
+	}
+	if metaData.Snapshots == nil {
+		return []Snapshot{}, nil
+	}
+	return metaData.Snapshots, nil
+}
+
+// CreateSnapshot takes an internal snapshot of the root volume and all extra volumes of the VM.
+// If the VM is running, the snapshot is taken via QMP and it holds only the disk state.
+func CreateSnapshot(name, snapName string) (*VMMetaData, error) {
+	metaData, err := GetVM(name)
+	if err != nil {
+		return nil, errors.Wrap(err, "CreateSnapshot: Failed to get VM metadata")
+	}
+	if metaData.Lock {
+		return nil, errors.New("VM is locked")
+	}
+
+	if snapName == "" {
+		snapName = time.Now().Format("20060102-150405")
+	}
+	if _, s := findSnapshot(metaData, snapName); s != nil {
+		return nil, errors.Errorf("CreateSnapshot: snapshot '%s' already exists", snapName)
+	}
+
+	paths := getVolumePaths(metaData)
+	if metaData.Status == "stopped" || metaData.Status == "suspended" {
+		for i, p := range paths {
+			err = CreateImageSnapshot(p, snapName)
+			if err != nil {
+				for _, created := range paths[:i] {
+					if rmErr := DeleteImageSnapshot(created, snapName); rmErr != nil {
+						log.Println("Ignore DeleteImageSnapshot error:", rmErr)
+					}
+				}
+				return nil, errors.Wrap(err, "CreateSnapshot: Failed to create snapshot")
+			}
+		}
+	} else {
+		err = executeSnapshotQMPCommand(name, "blockdev-snapshot-internal-sync", "blockdev-snapshot-delete-internal-sync", snapName, paths)
+		if err != nil {
+			return nil, errors.Wrap(err, "CreateSnapshot: Failed to create snapshot")
+		}
+	}
+
+	metaData.Snapshots = append(metaData.Snapshots, Snapshot{
+		Name:      snapName,
+		CreatedAt: time.Now(),
+		Volumes:   paths,
+	})
+	err = saveVMMetaData(name, metaData)
+	if err != nil {
+		return nil, err
+	}
+
+	return metaData, nil
+}
+
+// RevertSnapshot reverts volumes of the VM to the snapshot. The VM must be stopped.
+func RevertSnapshot(name, snapName string) (*VMMetaData, error) {
+	metaData, err := GetVM(name)
+	if err != nil {
+		return nil, errors.Wrap(err, "RevertSnapshot: Failed to get VM metadata")
+	}
+	if metaData.Lock {
+		return nil, errors.New("VM is locked")
+	}
+	if metaData.Status != "stopped" {
+		return nil, errors.New("Cannot revert non-stopped VM")
+	}
+
+	_, s := findSnapshot(metaData, snapName)
+	if s == nil {
+		return nil, fmt.Errorf("Cannot revert to '%s'. No such a snapshot", snapName)
+	}
+
+	// reverting only some of the volumes leaves them inconsistent, so check all of them first
+	for _, p := range s.Volumes {
+		if !exists(p) {
+			return nil, errors.Errorf("RevertSnapshot: volume '%s' of the snapshot is removed", p)
+		}
+	}
+	for _, p := range s.Volumes {
+		err = RevertImageSnapshot(p, snapName)
+		if err != nil {
+			return nil, errors.Wrap(err, "RevertSnapshot: Failed to revert snapshot")
+		}
+	}
+
+	return metaData, nil
+}
+
+// DeleteSnapshot deletes the snapshot from volumes of the VM.
+func DeleteSnapshot(name, snapName string) (*VMMetaData, error) {
+	metaData, err := GetVM(name)
+	if err != nil {
+		return nil, errors.Wrap(err, "DeleteSnapshot: Failed to get VM metadata")
+	}
+	if metaData.Lock {
+		return nil, errors.New("VM is locked")
+	}
+
+	i, s := findSnapshot(metaData, snapName)
+	if s == nil {
+		return nil, fmt.Errorf("Cannot delete '%s'. No such a snapshot", snapName)
+	}
+
+	paths := []string{}
+	for _, p := range s.Volumes {
+		if exists(p) {
+			paths = append(paths, p)
+		}
+	}
+	if metaData.Status == "stopped" || metaData.Status == "suspended" {
+		for _, p := range paths {
+			err = DeleteImageSnapshot(p, snapName)
+			if err != nil {
+				return nil, errors.Wrap(err, "DeleteSnapshot: Failed to delete snapshot")
+			}
+		}
+	} else {
+		err = executeSnapshotQMPCommand(name, "blockdev-snapshot-delete-internal-sync", "", snapName, paths)
+		if err != nil {
+			return nil, errors.Wrap(err, "DeleteSnapshot: Failed to delete snapshot")
+		}
+	}
+
+	metaData.Snapshots = append(metaData.Snapshots[:i], metaData.Snapshots[i+1:]...)
+	err = saveVMMetaData(name, metaData)
+	if err != nil {
+		return nil, err
+	}
+
+	return metaData, nil
+}
@@ -0,0 +1,172 @@
+package minivmm
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Restart policies of VM.
+const (
+	RestartNever   = "never"
+	RestartOnCrash = "on-crash"
+)
+
+var (
+	qemuLogFileName       = "qemu.log"
+	qemuStderrLogFileName = "qemu-stderr.log"
+	qemuCrashLogFileName  = "qemu-crash.log"
+
+	restartBackoffBase = 5 * time.Second
+	restartBackoffMax  = 5 * time.Minute
+	// a VM running longer than this is regarded as stable, and its backoff is reset
+	restartBackoffResetAfter = 10 * time.Minute
+
+	// QEMU's shutdown reasons which are not initiated by the guest or the host operator
+	crashShutdownReasons = []string{"shutdown: host-error", "shutdown: guest-panic"}
+)
+
+func getQemuLogPath(name string) string {
+	return filepath.Join(C.VMDir, name, qemuLogFileName)
+}
+
+// launchQemu launches a daemonized QEMU whose stderr is kept in the log file in the VM directory.
+func launchQemu(name, binary string, params []string) error {
+	// QEMU truncates the log file by itself, so the stderr before daemonizing is written into another file
+	stderrPath := filepath.Join(C.VMDir, name, qemuStderrLogFileName)
+	f, err := os.OpenFile(stderrPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// QEMU keeps its stderr after daemonizing only if the log file is given
+	params = append(params, "-D", getQemuLogPath(name))
+	cmd := exec.Command(binary, params...)
+	cmd.Stderr = f
+	err = cmd.Run()
+	if err != nil {
+		msg, _ := os.ReadFile(stderrPath)
+		return fmt.Errorf("%v: %s", err, msg)
+	}
+	return nil
+}
+
+func isCrashReason(reason string) bool {
+	if reason == qemuExitedReason {
+		return true
+	}
+	for _, r := range crashShutdownReasons {
+		if reason == r {
+			return true
+		}
+	}
+	return false
+}
+
+// recordVMCrash increments the crash count of VM and saves the stderr of the crashed QEMU.
+func recordVMCrash(name, reason string) (*VMMetaData, error) {
+	metaData, err := updateVMMetaData(name, func(metaData *VMMetaData) {
+		metaData.CrashCount++
+		metaData.LastCrashAt = time.Now()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	src, err := os.Open(getQemuLogPath(name))
+	if err != nil {
+		return metaData, nil
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(filepath.Join(C.VMDir, name, qemuCrashLogFileName), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer dst.Close()
+	fmt.Fprintf(dst, "crashed at %s: %s\n", metaData.LastCrashAt.Format(time.RFC3339), reason)
+	io.Copy(dst, src)
+
+	return metaData, nil
+}
+
+// vmSupervisor restarts the crashed VM with exponential backoff.
+type vmSupervisor struct {
+	name      string
+	startedAt time.Time
+	crashes   int
+}
+
+func (s *vmSupervisor) started() {
+	s.startedAt = time.Now()
+}
+
+func (s *vmSupervisor) backoff() time.Duration {
+	if time.Since(s.startedAt) > restartBackoffResetAfter {
+		s.crashes = 0
+	}
+	s.crashes++
+	return exponentialBackoff(restartBackoffBase, restartBackoffMax, s.crashes)
+}
+
+// exponentialBackoff returns the delay before the n-th retry, which doubles from base up to max.
+func exponentialBackoff(base, max time.Duration, n int) time.Duration {
+	d := base
+	for i := 1; i < n && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+// handleExit is called when QEMU of the VM disconnects.
+func (s *vmSupervisor) handleExit(reason string) {
+	if !isCrashReason(reason) || getOfflineVMStatus(s.name) != "stopped" {
+		return
+	}
+
+	metaData, err := recordVMCrash(s.name, reason)
+	if err != nil {
+		log.Println("[supervisor] WARN failed to record crash:", err)
+		return
+	}
+	log.Printf("[supervisor] WARN %s crashed (%s), crash count: %d\n", s.name, reason, metaData.CrashCount)
+	if metaData.RestartPolicy != RestartOnCrash {
+		return
+	}
+
+	d := s.backoff()
+	log.Printf("[supervisor] INFO restarting %s in %v\n", s.name, d)
+	time.Sleep(d)
+	_, err = StartVM(s.name)
+	if err != nil {
+		log.Printf("[supervisor] WARN failed to restart %s: %v\n", s.name, err)
+	}
+}
+
+// SetVMRestartPolicy updates the restart policy of VM.
+func SetVMRestartPolicy(name, policy string) (*VMMetaData, error) {
+	metaData, err := GetVM(name)
+	if err != nil {
+		return nil, errors.Wrap(err, "SetVMRestartPolicy: Failed to get VM metadata")
+	}
+	if policy != RestartNever && policy != RestartOnCrash {
+		return nil, errors.Errorf("SetVMRestartPolicy: invalid restart policy '%s'", policy)
+	}
+
+	metaData.RestartPolicy = policy
+	err = saveVMMetaData(name, metaData)
+	if err != nil {
+		return nil, err
+	}
+
+	return metaData, nil
+}
@@ -0,0 +1,87 @@
+package minivmm
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	tpmStateDirName   = "tpm"
+	tpmSocketFileName = "swtpm.sock"
+	tpmPIDFileName    = "swtpm.pid"
+	tpmLogFileName    = "swtpm.log"
+)
+
+func getTPMSocketPath(name string) string {
+	return filepath.Join(C.VMDir, name, tpmSocketFileName)
+}
+
+func getTPMPIDFilePath(name string) string {
+	return filepath.Join(C.VMDir, name, tpmPIDFileName)
+}
+
+func validateTPM(arch string) error {
+	spec, err := getArchSpec(arch)
+	if err != nil {
+		return err
+	}
+	if spec.TPMDevice == "" {
+		return errors.Errorf("TPM is not supported on '%s'", arch)
+	}
+	return nil
+}
+
+// startTPM spawns the swtpm process of the VM. The TPM state is kept in the VM directory across restarts.
+// swtpm terminates by itself when QEMU closes the control channel.
+func startTPM(name string) error {
+	if _, ok := readAlivePID(getTPMPIDFilePath(name), "swtpm"); ok {
+		return nil
+	}
+
+	stateDir := filepath.Join(C.VMDir, name, tpmStateDirName)
+	err := os.MkdirAll(stateDir, 0700)
+	if err != nil {
+		return err
+	}
+	socketPath := getTPMSocketPath(name)
+	os.Remove(socketPath)
+
+	params := []string{
+		"swtpm", "socket", "--tpm2",
+		"--tpmstate", "dir=" + stateDir,
+		"--ctrl", "type=unixio,path=" + socketPath,
+		"--pid", "file=" + getTPMPIDFilePath(name),
+		"--log", "file=" + filepath.Join(C.VMDir, name, tpmLogFileName),
+		"--terminate", "--daemon",
+	}
+	log.Println("Starting TPM: ", params)
+	err = Execs([][]string{params})
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < 50; i++ {
+		if exists(socketPath) {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return errors.New("swtpm socket is not created")
+}
+
+// stopTPM kills the swtpm process of the VM if it's left.
+func stopTPM(name string) {
+	if pid, ok := readAlivePID(getTPMPIDFilePath(name), "swtpm"); ok {
+		err := syscall.Kill(pid, syscall.SIGTERM)
+		if err != nil {
+			log.Println("Ignore Kill error:", err)
+		}
+	}
+	os.Remove(getTPMPIDFilePath(name))
+	os.Remove(getTPMSocketPath(name))
+}
@@ -9,7 +9,10 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"text/template"
 	"time"
@@ -25,6 +28,7 @@ var (
 	cloudInitISOFileName      = "cloud-init.iso"
 	cloudInitUserDataFileName = "user-data"
 	cloudInitMetaDataFileName = "meta-data"
+	vmStateFileName           = "vm.state"
 	// VMIPAddressUpdateChan is a channel to update IP address by DHCP server
 	VMIPAddressUpdateChan = make(chan *VMMetaData)
 )
@@ -32,11 +36,13 @@ var (
 var vmIFSetupScriptTemplate = `#!/bin/sh
 if_name=$1
 sudo ip link set dev $if_name netns minivmm
-sudo ip netns exec minivmm ip link set dev $if_name master br-minivmm
+sudo ip netns exec minivmm ip link set dev $if_name master {{.Bridge}}
 sudo ip netns exec minivmm ip link set dev $if_name promisc on
 sudo ip netns exec minivmm ip link set dev $if_name up
 `
 
+var vmIFCleanupScriptPath = "/tmp/ifdown"
+
 var vmIFCleanupScriptTemplate = `#!/bin/sh
 if_name=$1
 sudo ip netns exec minivmm ip link set dev $if_name down
@@ -52,6 +58,11 @@ type VMMetaData struct {
 	Owner        string        `json:"owner"`
 	Image        string        `json:"image"`
 	Arch         string        `json:"arch"`
+	Firmware     string        `json:"firmware"`
+	TPM          bool          `json:"tpm"`
+	Hardware     *Hardware     `json:"hardware"`
+	TargetMemory string        `json:"target_memory"`
+	QoS          *QoS          `json:"qos"`
 	Volume       string        `json:"volume"`
 	MacAddress   string        `json:"mac_address"`
 	IPAddress    string        `json:"ip_address"`
@@ -64,6 +75,28 @@ type VMMetaData struct {
 	UserData     string        `json:"user_data"`
 	CloudInitIso string        `json:"cloud_init_iso"`
 	ExtraVolumes []ExtraVolume `json:"extra_volumes"`
+	Snapshots    []Snapshot    `json:"snapshots"`
+
+	// Network is the network the primary NIC is attached to. Empty means the default network.
+	Network string `json:"network"`
+	// StaticIPAddress is the IP address the DHCP server always gives to the primary NIC.
+	StaticIPAddress string     `json:"static_ip_address"`
+	ExtraNICs       []ExtraNIC `json:"extra_nics"`
+
+	StatusChangedAt time.Time `json:"status_changed_at"`
+	StatusReason    string    `json:"status_reason"`
+	LastStatus      string    `json:"last_status"`
+
+	Autostart      string `json:"autostart"`
+	AutostartOrder int    `json:"autostart_order"`
+
+	RestartPolicy string    `json:"restart_policy"`
+	CrashCount    int       `json:"crash_count"`
+	LastCrashAt   time.Time `json:"last_crash_at"`
+
+	// DevicesChanged is true when the devices of the running VM differ from its command line, e.g. by hot-plug.
+	// Such VM cannot be suspended because the command line on resume does not match the saved state.
+	DevicesChanged bool `json:"devices_changed"`
 }
 
 // ExtraVolume is extra volume's metadata
@@ -121,7 +154,7 @@ func getMachineArch() (string, error) {
 		if int(val) == 0 {
 			continue
 		}
-		m += string(int(val))
+		m += string(rune(val))
 	}
 
 	return m, nil
@@ -141,40 +174,6 @@ func getMachineArchFromMetaData(metaData *VMMetaData) string {
 	return "x86_64"
 }
 
-func generateQemuParams(qmpSocketPath, vncSocketPath, driveFilePath, machineArch, cloudInitISOPath, vmMACAddr, vmIFName, cpu, memory string, extraVolumes []string) []string {
-	params := make([]string, 0, 32)
-
-	if !C.NoKvm {
-		params = append(params, "--enable-kvm")
-		params = append(params, "-cpu", "host")
-	}
-
-	envVNCKeyboardLayout := C.VNCKeyboardLayout
-
-	params = append(params, "-drive", fmt.Sprintf("file=%s,if=virtio,cache=none,aio=threads,format=qcow2", driveFilePath))
-	if extraVolumes != nil {
-		for _, vol := range extraVolumes {
-			params = append(params, "-drive", fmt.Sprintf("file=%s,if=virtio,cache=none,aio=threads,format=qcow2", vol))
-		}
-	}
-
-	if machineArch == "aarch64" {
-		params = append(params, "-machine", "virt")
-		params = append(params, "-bios", "/usr/share/qemu-efi-aarch64/QEMU_EFI.fd")
-	}
-
-	params = append(params, "-cdrom", cloudInitISOPath)
-	params = append(params, "-net", fmt.Sprintf("nic,model=virtio,macaddr=%s", vmMACAddr))
-	params = append(params, "-net", fmt.Sprintf("tap,ifname=%s,script=/tmp/ifup,downscript=/tmp/ifdown", vmIFName))
-	params = append(params, "-daemonize")
-	params = append(params, "-qmp", fmt.Sprintf("unix:%s,server,nowait", qmpSocketPath))
-	params = append(params, "-m", memory, "-smp", fmt.Sprintf("cpus=%s", cpu))
-	params = append(params, "-vnc", fmt.Sprintf("unix:%s", vncSocketPath))
-	params = append(params, "-k", envVNCKeyboardLayout)
-
-	return params
-}
-
 func generateMACAddress() string {
 	vendor := "52:54:00"
 	buf := make([]byte, 3)
@@ -182,14 +181,19 @@ func generateMACAddress() string {
 	return fmt.Sprintf("%s:%02x:%02x:%02x", vendor, buf[0], buf[1], buf[2])
 }
 
-func generateVMIFSetupScript(path string) error {
+// getVMIFSetupScriptPath returns the path of the script QEMU runs to attach the tap to the bridge.
+func getVMIFSetupScriptPath(bridge string) string {
+	return "/tmp/ifup-" + bridge
+}
+
+func generateVMIFSetupScript(path, bridge string) error {
 	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0755)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 	t := template.Must(template.New("ifscript").Parse(vmIFSetupScriptTemplate))
-	err = t.Execute(f, nil)
+	err = t.Execute(f, struct{ Bridge string }{bridge})
 	if err != nil {
 		return err
 	}
@@ -226,6 +230,26 @@ func initQMP(qmpSocketPath string) (*qemu.QMP, chan struct{}, error) {
 	return q, disconnectedCh, nil
 }
 
+// executeQMPCommand executes a QMP command and decodes its response into out.
+// If out is nil, the response is discarded.
+func executeQMPCommand(q *qemu.QMP, name string, args map[string]interface{}, out interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	resp, err := q.ExecuteRawCommand(ctx, name, args, nil)
+	if err != nil {
+		return err
+	}
+	if out == nil {
+		return nil
+	}
+
+	b, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, out)
+}
+
 func getQMPSocketPath(name string) string {
 	return filepath.Join(C.VMDir, name, qmpSocketFileName)
 }
@@ -234,6 +258,10 @@ func getVNCSocketPath(name string) string {
 	return filepath.Join(C.VMDir, name, vncSocketFileName)
 }
 
+func getVMStatePath(name string) string {
+	return filepath.Join(C.VMDir, name, vmStateFileName)
+}
+
 func generateRandomPassword() (string, error) {
 	b := make([]byte, 8)
 	_, err := rand.Read(b)
@@ -249,7 +277,54 @@ func generateRandomPassword() (string, error) {
 // func GetVncPort(name string) (string, error) {
 // }
 
+// vmMetaDataLocks serializes the metadata writes per VM.
+var vmMetaDataLocks = struct {
+	sync.Mutex
+	m map[string]*sync.Mutex
+}{m: map[string]*sync.Mutex{}}
+
+func lockVMMetaData(name string) func() {
+	vmMetaDataLocks.Lock()
+	l, ok := vmMetaDataLocks.m[name]
+	if !ok {
+		l = &sync.Mutex{}
+		vmMetaDataLocks.m[name] = l
+	}
+	vmMetaDataLocks.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+// saveVMMetaData saves the VM metadata. The status and crash records are kept as saved, because they are updated
+// by the monitor while the metadata is being changed by the other operations.
 func saveVMMetaData(name string, metaData *VMMetaData) error {
+	unlock := lockVMMetaData(name)
+	defer unlock()
+
+	if cur, err := loadVMMetaData(name); err == nil {
+		metaData.StatusChangedAt = cur.StatusChangedAt
+		metaData.StatusReason = cur.StatusReason
+		metaData.LastStatus = cur.LastStatus
+		metaData.CrashCount = cur.CrashCount
+		metaData.LastCrashAt = cur.LastCrashAt
+	}
+	return writeVMMetaData(name, metaData)
+}
+
+// updateVMMetaData loads the VM metadata, applies the update and saves it atomically.
+func updateVMMetaData(name string, update func(*VMMetaData)) (*VMMetaData, error) {
+	unlock := lockVMMetaData(name)
+	defer unlock()
+
+	metaData, err := loadVMMetaData(name)
+	if err != nil {
+		return nil, err
+	}
+	update(metaData)
+	return metaData, writeVMMetaData(name, metaData)
+}
+
+func writeVMMetaData(name string, metaData *VMMetaData) error {
 	metaDataByte, err := json.Marshal(metaData)
 	if err != nil {
 		return err
@@ -285,7 +360,9 @@ func loadVMMetaData(name string) (*VMMetaData, error) {
 	return &vmMetaData, nil
 }
 
-func createCloudInitISO(cloudInitFilesPath, isoPath, name, userData string) error {
+// createCloudInitISO generates cloud-init ISO. If instanceID is given, it's written in meta-data.
+// A new instance ID makes cloud-init run its per-instance modules again, such as setting the hostname.
+func createCloudInitISO(cloudInitFilesPath, isoPath, name, instanceID, userData string) error {
 	// write userdata
 	userDataPath := filepath.Join(cloudInitFilesPath, cloudInitUserDataFileName)
 	userDataFile, err := os.OpenFile(userDataPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
@@ -304,6 +381,9 @@ func createCloudInitISO(cloudInitFilesPath, isoPath, name, userData string) erro
 	}
 	defer metaDataFile.Close()
 	metaData := fmt.Sprintf("local-hostname: %s", name)
+	if instanceID != "" {
+		metaData = fmt.Sprintf("instance-id: %s\n%s", instanceID, metaData)
+	}
 	metaDataFile.Write([]byte(metaData))
 
 	err = Execs([][]string{
@@ -313,11 +393,93 @@ func createCloudInitISO(cloudInitFilesPath, isoPath, name, userData string) erro
 }
 
 // CreateVM creates new VM and starts it.
-func CreateVM(name, owner, imageName, cpu, memory, disk, userData, tag string) (ret *VMMetaData, retErr error) {
+func CreateVM(name, owner, imageName, arch, firmware string, tpm bool, hw *Hardware, qos *QoS, cpu, memory, disk, userData, tag, network, staticIP string, extraNetworks []string) (ret *VMMetaData, retErr error) {
+	err := validateVMName(name, len(extraNetworks))
+	if err != nil {
+		return nil, errors.Wrap(err, "CreateVM")
+	}
 	if exists(filepath.Join(C.VMDir, name, vmMetaDataFileName)) {
 		return nil, errors.Errorf("CreateVM: VM '%s' already exists", name)
 	}
 
+	machineArch, err := resolveVMArch(arch, imageName)
+	if err != nil {
+		return nil, errors.Wrap(err, "CreateVM")
+	}
+	err = validateFirmware(machineArch, firmware)
+	if err != nil {
+		return nil, errors.Wrap(err, "CreateVM")
+	}
+	if tpm {
+		err = validateTPM(machineArch)
+		if err != nil {
+			return nil, errors.Wrap(err, "CreateVM")
+		}
+	}
+	if hw == nil {
+		hw = newHardware()
+	}
+	hw.setDefaults()
+	err = hw.validate(firmware == FirmwareUEFISecureBoot)
+	if err != nil {
+		return nil, errors.Wrap(err, "CreateVM")
+	}
+	err = validateCPUTopology(cpu, hw.CPU)
+	if err != nil {
+		return nil, errors.Wrap(err, "CreateVM")
+	}
+	err = validateCPUPlacement(hw.CPU)
+	if err != nil {
+		return nil, errors.Wrap(err, "CreateVM")
+	}
+	err = validateMemoryHotplug(memory, hw.Memory)
+	if err != nil {
+		return nil, errors.Wrap(err, "CreateVM")
+	}
+	if qos != nil {
+		err = qos.validate()
+		if err != nil {
+			return nil, errors.Wrap(err, "CreateVM")
+		}
+	}
+	if disk == "" && imageName != "" {
+		// the disk has the same size as the image
+		info, err := getImageInfo(filepath.Join(C.ImageDir, imageName))
+		if err != nil {
+			return nil, errors.Wrap(err, "CreateVM")
+		}
+		disk = strconv.FormatInt(info.VirtualSize, 10)
+	}
+	req, err := newQuotaRequest(cpu, memory, disk)
+	if err != nil {
+		return nil, errors.Wrap(err, "CreateVM")
+	}
+	req.VMs = 1
+	release, err := ReserveQuota(owner, req)
+	if err != nil {
+		return nil, errors.Wrap(err, "CreateVM")
+	}
+	defer release()
+	releaseAdmission, err := reserveAdmission(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "CreateVM")
+	}
+	defer releaseAdmission()
+	nw, err := getNetworkForOwner(network, owner)
+	if err != nil {
+		return nil, errors.Wrap(err, "CreateVM")
+	}
+	if staticIP != "" {
+		err = validateStaticIPAddress(nw.Name, staticIP)
+		if err != nil {
+			return nil, errors.Wrap(err, "CreateVM")
+		}
+	}
+	extraNICs, err := newExtraNICs(extraNetworks, owner)
+	if err != nil {
+		return nil, errors.Wrap(err, "CreateVM")
+	}
+
 	defer func() {
 		if retErr != nil && name != "" {
 			rmErr := os.RemoveAll(filepath.Join(C.VMDir, name))
@@ -336,7 +498,7 @@ func CreateVM(name, owner, imageName, cpu, memory, disk, userData, tag string) (
 	// to support cloud-init, generate userdata ISO
 	isoFilePath := filepath.Join(C.VMDir, name, cloudInitISOFileName)
 	userDataPath := filepath.Join(C.VMDir, name)
-	err = createCloudInitISO(userDataPath, isoFilePath, name, userData)
+	err = createCloudInitISO(userDataPath, isoFilePath, name, "", userData)
 	if err != nil {
 		return nil, err
 	}
@@ -344,17 +506,15 @@ func CreateVM(name, owner, imageName, cpu, memory, disk, userData, tag string) (
 	vmMACAddr := generateMACAddress()
 	password, _ := generateRandomPassword()
 
-	machineArch, err := getMachineArch()
-	if err != nil {
-		log.Println(err)
-		machineArch = "x86_64"
-	}
-
 	metaData := &VMMetaData{
 		Name:         name,
 		Owner:        owner,
 		Image:        imageName,
 		Arch:         machineArch,
+		Firmware:     firmware,
+		TPM:          tpm,
+		Hardware:     hw,
+		QoS:          qos,
 		Volume:       driveFilePath,
 		MacAddress:   vmMACAddr,
 		CPU:          cpu,
@@ -365,11 +525,30 @@ func CreateVM(name, owner, imageName, cpu, memory, disk, userData, tag string) (
 		VNCPassword:  password,
 		UserData:     userData,
 		CloudInitIso: isoFilePath,
+
+		Network:         nw.Name,
+		StaticIPAddress: staticIP,
+		ExtraNICs:       extraNICs,
 	}
 	err = saveVMMetaData(name, metaData)
 	if err != nil {
 		return nil, err
 	}
+	// the saved VM is counted as the usage, and its vCPUs and memory are reserved again by StartVM
+	release()
+	releaseAdmission()
+
+	if staticIP != "" {
+		err = reserveIPAddress(nw.Name, vmMACAddr, staticIP)
+		if err != nil {
+			return nil, errors.Wrap(err, "CreateVM")
+		}
+		defer func() {
+			if retErr != nil {
+				releaseIPAddress(nw.Name, vmMACAddr)
+			}
+		}()
+	}
 
 	metaData, err = StartVM(name)
 	if err != nil {
@@ -384,11 +563,173 @@ func CreateVM(name, owner, imageName, cpu, memory, disk, userData, tag string) (
 	return metaData, nil
 }
 
+// vmNameRegexp matches the names which can be used as the VM directory and the guest hostname.
+var vmNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9-]*$`)
+
+// maxIFNameLen is the maximum length of network interface names on Linux (IFNAMSIZ - 1).
+const maxIFNameLen = 15
+
+// validateVMName checks the name, including that the tap interface names of the VM with the extra NICs are not
+// too long.
+func validateVMName(name string, extraNICs int) error {
+	if !vmNameRegexp.MatchString(name) {
+		return errors.Errorf("invalid VM name '%s'", name)
+	}
+	ifName := fmt.Sprintf("tap-%s", name)
+	if extraNICs > 0 {
+		ifName = fmt.Sprintf("tap-%s-%d", name, extraNICs)
+	}
+	if len(ifName) > maxIFNameLen {
+		return errors.Errorf("VM name '%s' is too long for the interface name '%s'", name, ifName)
+	}
+	return nil
+}
+
+// CloneVM creates a new VM with copies of the source VM's root disk and extra volumes, and starts it.
+// The root disk of the new VM is backed by the same base image as the source one.
+func CloneVM(srcName, name, owner, userData string, keepUserData bool) (ret *VMMetaData, retErr error) {
+	src, err := GetVM(srcName)
+	if err != nil {
+		return nil, errors.Wrap(err, "CloneVM: Failed to get source VM metadata")
+	}
+	err = validateVMName(name, len(src.ExtraNICs))
+	if err != nil {
+		return nil, errors.Wrap(err, "CloneVM")
+	}
+	if src.Status != "stopped" && src.Status != "suspended" {
+		return nil, errors.New("Cannot clone non-stopped VM")
+	}
+	if exists(filepath.Join(C.VMDir, name, vmMetaDataFileName)) {
+		return nil, errors.Errorf("CloneVM: VM '%s' already exists", name)
+	}
+	req, err := newQuotaRequest(src.CPU, src.Memory, "")
+	if err != nil {
+		return nil, errors.Wrap(err, "CloneVM")
+	}
+	req.Disk, err = getVMDiskBytes(src)
+	if err != nil {
+		return nil, errors.Wrap(err, "CloneVM")
+	}
+	req.VMs = 1
+	for _, vol := range src.ExtraVolumes {
+		size, err := parseBytes(vol.Size)
+		if err != nil {
+			return nil, errors.Wrap(err, "CloneVM")
+		}
+		req.Disk += size
+		req.ExtraVolumes++
+	}
+	release, err := ReserveQuota(owner, req)
+	if err != nil {
+		return nil, errors.Wrap(err, "CloneVM")
+	}
+	defer release()
+	releaseAdmission, err := reserveAdmission(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "CloneVM")
+	}
+	defer releaseAdmission()
+
+	defer func() {
+		if retErr != nil && name != "" {
+			rmErr := os.RemoveAll(filepath.Join(C.VMDir, name))
+			if rmErr != nil {
+				log.Println("Ignore RemoveAll error:", rmErr)
+			}
+		}
+	}()
+
+	vmDataDir := filepath.Join(C.VMDir, name)
+	driveFilePath, err := CopyImage(src.Volume, name, src.Image, vmDataDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "CloneVM: Failed to copy root disk")
+	}
+
+	extraVolumes := []ExtraVolume{}
+	for _, vol := range src.ExtraVolumes {
+		path, err := CopyImage(vol.Path, vol.Name, "", vmDataDir)
+		if err != nil {
+			return nil, errors.Wrap(err, "CloneVM: Failed to copy extra volume")
+		}
+		extraVolumes = append(extraVolumes, ExtraVolume{Name: vol.Name, Path: path, Size: vol.Size})
+	}
+
+	extraNICs := []ExtraNIC{}
+	for _, nic := range src.ExtraNICs {
+		extraNICs = append(extraNICs, ExtraNIC{Network: nic.Network, MacAddress: generateMACAddress()})
+	}
+
+	// keep the boot entries of the source VM
+	if exists(getNVRAMPath(srcName)) {
+		err = copyFile(getNVRAMPath(srcName), getNVRAMPath(name))
+		if err != nil {
+			return nil, errors.Wrap(err, "CloneVM: Failed to copy UEFI variable store")
+		}
+	}
+
+	if keepUserData {
+		userData = src.UserData
+	}
+	isoFilePath := filepath.Join(C.VMDir, name, cloudInitISOFileName)
+	userDataPath := filepath.Join(C.VMDir, name)
+	err = createCloudInitISO(userDataPath, isoFilePath, name, name, userData)
+	if err != nil {
+		return nil, err
+	}
+
+	password, _ := generateRandomPassword()
+
+	metaData := &VMMetaData{
+		Name:     name,
+		Owner:    owner,
+		Image:    src.Image,
+		Arch:     src.Arch,
+		Firmware: src.Firmware,
+		// the TPM state is not copied, so that the clone has its own endorsement key
+		TPM:          src.TPM,
+		Hardware:     src.Hardware,
+		QoS:          src.QoS,
+		Volume:       driveFilePath,
+		MacAddress:   generateMACAddress(),
+		CPU:          src.CPU,
+		Memory:       src.Memory,
+		Disk:         src.Disk,
+		Tag:          src.Tag,
+		Lock:         false,
+		VNCPassword:  password,
+		UserData:     userData,
+		CloudInitIso: isoFilePath,
+		ExtraVolumes: extraVolumes,
+
+		Network:   src.Network,
+		ExtraNICs: extraNICs,
+	}
+	err = saveVMMetaData(name, metaData)
+	if err != nil {
+		return nil, err
+	}
+	// the saved VM is counted as the usage, and its vCPUs and memory are reserved again by StartVM
+	release()
+	releaseAdmission()
+
+	metaData, err = StartVM(name)
+	if err != nil {
+		return nil, err
+	}
+	err = saveVMMetaData(name, metaData)
+	if err != nil {
+		return nil, err
+	}
+
+	return metaData, nil
+}
+
 // StopVM shuts down VM.
 func StopVM(name string) error {
 	status := getVMStatus(name)
-	if status == "stopped" {
-		// VM has already stopped
+	if status == "stopped" || status == "suspended" {
+		// VM has already stopped, but swtpm may be left when QEMU was killed
+		stopTPM(name)
 		return nil
 	}
 
@@ -409,43 +750,205 @@ func StopVM(name string) error {
 
 	q.Shutdown()
 	<-disconnectedCh
+	notifyVMStatusChange(name)
 
 	return nil
 }
 
+// SuspendVM saves the RAM and device state of the VM into the VM directory and quits it.
+// The saved state is restored on the next StartVM.
+func SuspendVM(name string) error {
+	status := getVMStatus(name)
+	if status == "stopped" || status == "suspended" {
+		return errors.New("Cannot suspend non-running VM")
+	}
+	metaData, err := loadVMMetaData(name)
+	if err != nil {
+		return errors.Wrap(err, "SuspendVM: VM metadata load failed")
+	}
+	if metaData.DevicesChanged {
+		return errors.New("Cannot suspend VM whose devices are changed since boot, restart it first")
+	}
+
+	q, disconnectedCh, err := initQMP(getQMPSocketPath(name))
+	if err != nil {
+		return errors.Wrap(err, "SuspendVM: QMP connection cannot established")
+	}
+	defer func() {
+		q.Shutdown()
+		<-disconnectedCh
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	err = q.ExecuteStop(ctx)
+	cancel()
+	if err != nil {
+		return errors.Wrap(err, "SuspendVM: ExecuteStop failed")
+	}
+
+	// write to a temporary file so that incomplete state is never resumed
+	statePath := getVMStatePath(name)
+	tmpStatePath := statePath + ".tmp"
+	err = saveVMState(q, tmpStatePath)
+	if err != nil {
+		os.Remove(tmpStatePath)
+		contErr := q.ExecuteCont(context.Background())
+		if contErr != nil {
+			log.Println("Ignore ExecuteCont error:", contErr)
+		}
+		return errors.Wrap(err, "SuspendVM: Failed to save VM state")
+	}
+	err = os.Rename(tmpStatePath, statePath)
+	if err != nil {
+		return err
+	}
+
+	err = q.ExecuteQuit(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "SuspendVM: ExecuteQuit failed")
+	}
+	notifyVMStatusChange(name)
+
+	return nil
+}
+
+func saveVMState(q *qemu.QMP, path string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	// file: URI is opened by QEMU itself, so the path is never interpreted by a shell
+	err := q.ExecSetMigrateArguments(ctx, "file:"+path)
+	cancel()
+	if err != nil {
+		return err
+	}
+
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		m, err := q.ExecuteQueryMigration(ctx)
+		cancel()
+		if err != nil {
+			return err
+		}
+
+		switch m.Status {
+		case "completed":
+			return nil
+		case "failed", "cancelled":
+			return fmt.Errorf("migration %s", m.Status)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// waitForVMStateLoaded waits until the VM finishes loading the suspended state, resumes it, and then removes the state file.
+func waitForVMStateLoaded(name string) error {
+	status, err := waitForVMStatusChange(name, "inmigrate")
+	if err != nil {
+		return err
+	}
+	switch status {
+	case "running":
+	case "paused", "postmigrate", "prelaunch":
+		// the VM was stopped before saving, so the loaded state is paused
+		err = withQMP(name, func(q *qemu.QMP) error {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			return q.ExecuteCont(ctx)
+		})
+		if err != nil {
+			return errors.Wrap(err, "ExecuteCont failed")
+		}
+		status, err = waitForVMStatusChange(name, status)
+		if err != nil {
+			return err
+		}
+		if status != "running" {
+			return fmt.Errorf("VM is '%s' after resuming", status)
+		}
+	default:
+		return fmt.Errorf("unexpected status '%s' while resuming", status)
+	}
+	return os.Remove(getVMStatePath(name))
+}
+
+// waitForVMStatusChange waits until the VM status becomes other than the given one.
+func waitForVMStatusChange(name, from string) (string, error) {
+	for i := 0; i < 600; i++ {
+		status := getVMStatus(name)
+		if status != from && status != "unknown" {
+			return status, nil
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	return "", errors.New("waiting for resuming is timed out")
+}
+
 func prepareStartVM(name string, metaData *VMMetaData) ([]string, error) {
-	qmpSocketPath := getQMPSocketPath(name)
-	vncSocketPath := getVNCSocketPath(name)
-	driveFilePath := metaData.Volume
 	machineArch := getMachineArchFromMetaData(metaData)
-	cloudInitISOPath := metaData.CloudInitIso
-	vmMACAddr := metaData.MacAddress
-	cpu := metaData.CPU
 	memory, err := ConvertSIPrefixedValue(metaData.Memory, "mebi")
 	if err != nil {
 		return nil, err
 	}
-	extraVolumes := []string{}
-	if metaData.ExtraVolumes != nil {
-		for _, vol := range metaData.ExtraVolumes {
-			extraVolumes = append(extraVolumes, vol.Path)
+	hw := metaData.Hardware
+	if hw == nil {
+		// VMs created before the hardware spec
+		hw = newLegacyHardware()
+	}
+	firmwareParams, err := generateFirmwareParams(name, machineArch, metaData.Firmware)
+	if err != nil {
+		return nil, errors.Wrap(err, "StartVM: firmware setup failed")
+	}
+	tpmSocketPath := ""
+	if metaData.TPM {
+		err = startTPM(name)
+		if err != nil {
+			return nil, errors.Wrap(err, "StartVM: TPM start failed")
 		}
+		tpmSocketPath = getTPMSocketPath(name)
 	}
-	vmIFName := fmt.Sprintf("tap-%s", name)
-	prepareVMIF(vmIFName)
-	qemuParams := generateQemuParams(qmpSocketPath, vncSocketPath, driveFilePath, machineArch, cloudInitISOPath, vmMACAddr, vmIFName, cpu, memory, extraVolumes)
-
 	log.Println("Prepare if script ...")
-	err = generateVMIFSetupScript("/tmp/ifup")
-	if err != nil {
-		return nil, errors.Wrap(err, "StartVM: VM interface setup script generate failed")
+	nics := []qemuNIC{}
+	for _, nic := range getVMNICs(metaData) {
+		n, err := GetNetwork(nic.Network)
+		if err != nil {
+			return nil, errors.Wrap(err, "StartVM")
+		}
+		nwInfo, err := getNetworkInfo(n)
+		if err != nil {
+			return nil, errors.Wrap(err, "StartVM")
+		}
+		script := getVMIFSetupScriptPath(nwInfo.bridge)
+		err = generateVMIFSetupScript(script, nwInfo.bridge)
+		if err != nil {
+			return nil, errors.Wrap(err, "StartVM: VM interface setup script generate failed")
+		}
+		prepareVMIF(nic.IFName)
+		nics = append(nics, qemuNIC{MacAddress: nic.MacAddress, IFName: nic.IFName, Script: script})
 	}
-	err = generateVMIFCleanupScript("/tmp/ifdown")
+	err = generateVMIFCleanupScript(vmIFCleanupScriptPath)
 	if err != nil {
 		return nil, errors.Wrap(err, "StartVM: VM interface setup script generate failed")
 	}
 
-	log.Println("Launching vm with: ", driveFilePath, qmpSocketFileName, qemuParams)
+	qemuParams := generateQemuParams(hw, &qemuConfig{
+		Arch:         machineArch,
+		KVM:          isKVMAvailable(machineArch),
+		SecureBoot:   metaData.Firmware == FirmwareUEFISecureBoot,
+		CPU:          metaData.CPU,
+		Memory:       memory,
+		Disks:        getVolumeDisks(metaData),
+		CloudInitISO: metaData.CloudInitIso,
+		NICs:         nics,
+		// the second QMP socket is dedicated to the status monitor, because QMP socket accepts only one client at a time
+		QMPSocketPaths:    []string{getQMPSocketPath(name), getQMPMonitorSocketPath(name)},
+		VNCSocketPath:     getVNCSocketPath(name),
+		VNCKeyboardLayout: C.VNCKeyboardLayout,
+		SerialLogPath:     filepath.Join(C.VMDir, name, serialLogFileName),
+		PIDFilePath:       getPIDFilePath(name),
+		FirmwareParams:    firmwareParams,
+		TPMSocketPath:     tpmSocketPath,
+	})
+
+	log.Println("Launching vm with: ", metaData.Volume, qmpSocketFileName, qemuParams)
 	return qemuParams, nil
 }
 
@@ -457,18 +960,64 @@ func StartVM(name string) (*VMMetaData, error) {
 	}
 
 	status := getVMStatus(name)
-	if status != "stopped" {
+	if status != "stopped" && status != "suspended" {
 		return nil, errors.New("Cannot start non-stopped VM")
 	}
+	releaseAdmission, err := reserveStartAdmission(metaData)
+	if err != nil {
+		return nil, err
+	}
+	defer releaseAdmission()
 
-	qemuBinaryName := "qemu-system-" + getMachineArchFromMetaData(metaData)
+	spec, err := getArchSpec(getMachineArchFromMetaData(metaData))
+	if err != nil {
+		return nil, errors.Wrap(err, "StartVM")
+	}
+	qemuBinaryName := spec.Binary
 	qemuParams, err := prepareStartVM(name, metaData)
-	stdErr, err := qemu.LaunchCustomQemu(context.Background(), qemuBinaryName, qemuParams, nil, nil, nil)
 	if err != nil {
-		log.Println(stdErr)
+		return nil, err
+	}
+	if status == "suspended" {
+		qemuParams = append(qemuParams, "-incoming", "file:"+getVMStatePath(name))
+	}
+	err = launchQemu(name, qemuBinaryName, qemuParams)
+	if err != nil {
+		stopTPM(name)
 		return nil, errors.Wrap(err, "StartVM: VM launch failed")
 	}
 
+	notifyVMStatusChange(name)
+
+	if status == "suspended" {
+		err = waitForVMStateLoaded(name)
+		if err != nil {
+			return nil, errors.Wrap(err, "StartVM: VM resume failed")
+		}
+	} else if metaData.DevicesChanged {
+		// the command line reflects all the changes
+		metaData.DevicesChanged = false
+		err = saveVMMetaData(name, metaData)
+		if err != nil {
+			log.Println("Ignore saveVMMetaData error:", err)
+		}
+	}
+
+	if metaData.Hardware != nil {
+		err = pinVCPUs(name, metaData.Hardware.CPU)
+		if err != nil {
+			log.Println("Ignore pinVCPUs error:", err)
+		}
+	}
+	setupBalloon(name, metaData)
+	if metaData.QoS != nil {
+		// the disk limits are given by the command line
+		err = setNICsQoS(metaData, metaData.QoS.NIC)
+		if err != nil {
+			log.Println("Ignore setNICsQoS error:", err)
+		}
+	}
+
 	return metaData, nil
 }
 
@@ -478,11 +1027,29 @@ func ResizeVM(name, cpu, memory, disk string) (*VMMetaData, error) {
 	if err != nil {
 		return nil, errors.Wrap(err, "ResizeVM: Failed to get VM metadata")
 	}
+	if metaData.Status == "suspended" {
+		return nil, errors.New("Cannot resize suspended VM")
+	}
+	release, err := reserveResizeQuota(metaData, cpu, memory, disk)
+	if err != nil {
+		return nil, errors.Wrap(err, "ResizeVM")
+	}
+	defer release()
 
 	if cpu != "" {
+		if metaData.Hardware != nil {
+			err = validateCPUTopology(cpu, metaData.Hardware.CPU)
+			if err != nil {
+				return nil, err
+			}
+		}
 		metaData.CPU = cpu
 	}
 	if memory != "" {
+		err = validateMemoryHotplug(memory, getHardware(metaData).Memory)
+		if err != nil {
+			return nil, err
+		}
 		metaData.Memory = memory
 	}
 	if disk != "" {
@@ -522,12 +1089,26 @@ func setVMLock(name string, lock bool) (*VMMetaData, error) {
 	return metaData, nil
 }
 
-// AddVolume adds a new extra volume to the VM
+// AddVolume adds a new extra volume to the VM. The volume is hot-plugged into the running VM if possible,
+// otherwise it's attached on the next boot.
 func AddVolume(name, size string) (*VMMetaData, error) {
 	metaData, err := GetVM(name)
 	if err != nil {
 		return nil, errors.Wrap(err, "AddVolume: Failed to get VM metadata")
 	}
+	if metaData.Status == "suspended" {
+		return nil, errors.New("Cannot add volume to suspended VM")
+	}
+	req, err := newQuotaRequest("", "", size)
+	if err != nil {
+		return nil, errors.Wrap(err, "AddVolume")
+	}
+	req.ExtraVolumes = 1
+	release, err := ReserveQuota(metaData.Owner, req)
+	if err != nil {
+		return nil, errors.Wrap(err, "AddVolume")
+	}
+	defer release()
 
 loop:
 	for i := 1; i <= 256; i++ {
@@ -546,6 +1127,9 @@ loop:
 
 		ev := ExtraVolume{Name: imageName, Path: path, Size: size}
 		metaData.ExtraVolumes = append(metaData.ExtraVolumes, ev)
+		if metaData.Status == "running" || metaData.Status == "paused" {
+			metaData.DevicesChanged = true
+		}
 
 		err = saveVMMetaData(name, metaData)
 		if err != nil {
@@ -553,6 +1137,20 @@ loop:
 			return nil, err
 		}
 
+		hw := getHardware(metaData)
+		if metaData.Status == "running" && isDiskHotpluggable(hw) {
+			err = withQMP(name, func(q *qemu.QMP) error {
+				err := hotplugVolume(q, hw, ev)
+				if err != nil || metaData.QoS == nil {
+					return err
+				}
+				return setDiskQoS(q, ev.Name, getDiskQoS(metaData.QoS, ev.Name))
+			})
+			if err != nil {
+				log.Printf("[hotplug] WARN %s: '%s' will be attached on the next boot: %v\n", name, imageName, err)
+			}
+		}
+
 		return metaData, nil
 	}
 
@@ -565,12 +1163,25 @@ func RemoveVolume(name, volName string) (*VMMetaData, error) {
 	if err != nil {
 		return nil, errors.Wrap(err, "RemoveVolume: Failed to get VM metadata")
 	}
+	if metaData.Status == "suspended" {
+		return nil, errors.New("Cannot remove volume from suspended VM")
+	}
 	if metaData.Lock {
 		return nil, errors.New("VM is locked")
 	}
 
 	for i, vol := range metaData.ExtraVolumes {
 		if volName == vol.Name {
+			if metaData.Status == "running" || metaData.Status == "paused" {
+				if !isDiskHotpluggable(getHardware(metaData)) {
+					return nil, errors.Wrap(ErrHotplugUnsupported, "RemoveVolume: stop the VM to remove the volume")
+				}
+				err = withQMP(name, func(q *qemu.QMP) error { return hotUnplugVolume(q, vol.Name) })
+				if err != nil {
+					return nil, errors.Wrap(err, "RemoveVolume: hot-unplug failed")
+				}
+				metaData.DevicesChanged = true
+			}
 			os.Remove(vol.Path)
 
 			metaData.ExtraVolumes = append(metaData.ExtraVolumes[:i], metaData.ExtraVolumes[i+1:]...)
@@ -591,8 +1202,9 @@ func getVMStatus(name string) string {
 	// VM status not saved in metadata
 	q, _, err := initQMP(getQMPSocketPath(name))
 	if err != nil {
-		return "stopped"
+		return getOfflineVMStatus(name)
 	}
+	defer q.Shutdown()
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	statusInfo, err := q.ExecuteQueryStatus(ctx)
@@ -601,11 +1213,18 @@ func getVMStatus(name string) string {
 		log.Println("getVMStatus: ", err)
 		return "unknown"
 	}
-	q.Shutdown()
 
 	return statusInfo.Status
 }
 
+// getCachedVMStatus returns the VM status kept by the monitor. If the VM is not monitored yet, it queries the status.
+func getCachedVMStatus(name string) string {
+	if status, ok := statusCache.get(name); ok {
+		return status
+	}
+	return getVMStatus(name)
+}
+
 // GetVM returns VM metadata.
 func GetVM(name string) (*VMMetaData, error) {
 	metaData, err := loadVMMetaData(name)
@@ -627,8 +1246,10 @@ func GetVMFromMac(mac string) (*VMMetaData, error) {
 	}
 
 	for _, metaData := range metaDataList {
-		if metaData.MacAddress == mac {
-			return metaData, nil
+		for _, nic := range getVMNICs(metaData) {
+			if nic.MacAddress == mac {
+				return metaData, nil
+			}
 		}
 	}
 
@@ -645,11 +1266,12 @@ func ListVMs() ([]*VMMetaData, error) {
 	var ret []*VMMetaData
 	for _, f := range dirEntries {
 		if f.IsDir() {
-			m, err := GetVM(f.Name())
+			m, err := loadVMMetaData(f.Name())
 			if err != nil {
-				log.Println("Ignore GetVM error:", err)
+				log.Println("Ignore loadVMMetaData error:", err)
 				continue
 			}
+			m.Status = getCachedVMStatus(f.Name())
 			ret = append(ret, m)
 		}
 	}
@@ -667,14 +1289,25 @@ func UpdateIPAddress() {
 			continue
 		}
 
-		e.IPAddress = r.IPAddress
+		primary := e.MacAddress == r.MacAddress
+		if primary {
+			e.IPAddress = r.IPAddress
+		}
+		for i := range e.ExtraNICs {
+			if e.ExtraNICs[i].MacAddress == r.MacAddress {
+				e.ExtraNICs[i].IPAddress = r.IPAddress
+			}
+		}
 		err = saveVMMetaData(e.Name, e)
 		if err != nil {
 			log.Println("Ignore saveVMMetaData error:", err)
 			continue
 		}
 
-		UpdateIPAddressInForwarder(e.Name, r.IPAddress)
+		// forwards are destined to the primary NIC
+		if primary {
+			UpdateIPAddressInForwarder(e.Name, r.IPAddress)
+		}
 	}
 }
 
@@ -692,6 +1325,11 @@ func RemoveVM(name string) error {
 	if err != nil {
 		return err
 	}
+	// the guest shuts down asynchronously, and swtpm must be alive until QEMU exits
+	err = waitQemuExit(name, qemuExitTimeout)
+	if err != nil {
+		return errors.Wrap(err, "RemoveVM")
+	}
 
 	vmIFName := fmt.Sprintf("tap-%s", name)
 	if isExistsVMIF(vmIFName) {
@@ -709,6 +1347,19 @@ func RemoveVM(name string) error {
 		}
 	}
 
+	stopTPM(name)
+	for _, nic := range getVMNICs(metaData)[1:] {
+		if isExistsVMIF(nic.IFName) {
+			err = cleanupVMIF(nic.IFName)
+			if err != nil {
+				log.Println("Ignore cleanupVMIF error:", err)
+			}
+		}
+	}
+	for _, nic := range getVMNICs(metaData) {
+		releaseIPAddress(nic.Network, nic.MacAddress)
+	}
+
 	vmDataDir := filepath.Join(C.VMDir, name)
 	err = os.RemoveAll(vmDataDir)
 	return err